@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+)
+
+const (
+	// 最多保存的请求体字节数，超过时无法解析出完整的JSON，也就无法脱敏，只记录长度
+	maxCapturedBody = 64 * 1024
+	// 脱敏之后日志中最多记录的字节数
+	maxLoggedBody = 2048
+)
+
+// 键名(不区分大小写)包含这些词的字段在记录之前被替换掉
+var sensitiveBodyKeys = []string{"password", "token", "secret", "authorization"}
+
+// 记录请求体的读取器，处理器照常读取，读到的内容同时保存下来
+type bodyCapture struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	total     int
+	truncated bool
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.total += n
+
+	if remaining := maxCapturedBody - c.buf.Len(); remaining > 0 {
+		c.buf.Write(p[:min(n, remaining)])
+	}
+	if c.buf.Len() < c.total {
+		c.truncated = true
+	}
+
+	return n, err
+}
+
+// logFailedRequestBodies 在响应为4xx/5xx时记录脱敏后的请求体，用于排查客户端的集成问题。
+// 只在env=development并且开启-debug-log-bodies时生效，处理器没有读取的部分不会被记录
+func (app *application) logFailedRequestBodies(next http.Handler) http.Handler {
+	if app.config.env != "development" || !app.config.debugLogBodies {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capture := &bodyCapture{ReadCloser: r.Body}
+		r.Body = capture
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		if metrics.Code < 400 || capture.total == 0 {
+			return
+		}
+
+		app.logger.PrintInfo("request body of failed request", map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"status":         strconv.Itoa(metrics.Code),
+			"body":           redactBody(capture),
+		})
+	})
+}
+
+// 返回脱敏并截断后的请求体。无法完整解析为JSON时不记录内容，避免泄露其中的密码
+func redactBody(c *bodyCapture) string {
+	if c.truncated {
+		return fmt.Sprintf("[body too large to redact, %d bytes]", c.total)
+	}
+
+	var body interface{}
+	err := json.Unmarshal(c.buf.Bytes(), &body)
+	if err != nil {
+		return fmt.Sprintf("[non-JSON body, %d bytes]", c.total)
+	}
+
+	js, err := json.Marshal(redactValue(body))
+	if err != nil {
+		return fmt.Sprintf("[unprintable body, %d bytes]", c.total)
+	}
+
+	if len(js) > maxLoggedBody {
+		return string(js[:maxLoggedBody]) + "...(truncated)"
+	}
+	return string(js)
+}
+
+// 递归替换对象中敏感字段的值
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isSensitiveKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveBodyKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LTXWorld/greenLight_copy/internal/jsonlog"
+)
+
+func TestLogFailedRequestBodies(t *testing.T) {
+	var logs bytes.Buffer
+
+	app := &application{logger: jsonlog.New(&logs, jsonlog.LevelInfo)}
+	app.config.env = "development"
+	app.config.debugLogBodies = true
+
+	// 处理器读取完整的请求体，name为bad时返回422
+	handler := app.logFailedRequestBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "bad") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+	}))
+
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{name: "success is not logged", body: `{"name":"good","password":"hunter22"}`, notWant: []string{"good"}},
+		{name: "secrets redacted", body: `{"name":"bad","password":"hunter22","nested":{"Token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ"}}`, want: []string{`bad`, redacted}, notWant: []string{"hunter22", "ABCDEFGHIJKLMNOPQRSTUVWXYZ"}},
+		{name: "non-JSON body", body: `name=bad&password=hunter22`, want: []string{"non-JSON body"}, notWant: []string{"hunter22"}},
+		{name: "truncated body", body: `{"name":"bad","password":"hunter22","padding":"` + strings.Repeat("a", maxCapturedBody) + `"}`, want: []string{"too large"}, notWant: []string{"hunter22"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(tt.body))
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			for _, s := range tt.want {
+				if !strings.Contains(logs.String(), s) {
+					t.Errorf("log %q does not contain %q", logs.String(), s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(logs.String(), s) {
+					t.Errorf("log %q contains %q", logs.String(), s)
+				}
+			}
+		})
+	}
+}
+
+// 不是development环境时即使开启了flag也不记录
+func TestLogFailedRequestBodiesOnlyInDevelopment(t *testing.T) {
+	app := &application{}
+	app.config.env = "production"
+	app.config.debugLogBodies = true
+
+	var captured bool
+	handler := app.logFailedRequestBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, captured = r.Body.(*bodyCapture)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"password":"hunter22"}`))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if captured {
+		t.Error("request body was captured outside development")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/jsonlog"
+	"github.com/LTXWorld/greenLight_copy/internal/mailer"
+	"github.com/LTXWorld/greenLight_copy/internal/rediscache"
+)
+
+// 启动前检查中的一项，run返回nil表示通过
+type configCheck struct {
+	name string
+	run  func() error
+}
+
+// checkConfig 依次执行所有检查并记录每一项的结果，不会启动服务器。
+// 某一项失败后仍然继续执行其余的检查，一次就能看到所有的问题，返回失败的项数
+func checkConfig(cfg config, logger *jsonlog.Logger) int {
+	checks := []configCheck{
+		{name: "tls", run: func() error {
+			if (cfg.tls.certFile == "") != (cfg.tls.keyFile == "") {
+				return errors.New("-tls-cert and -tls-key must be set together")
+			}
+			if cfg.tls.certFile == "" {
+				return nil
+			}
+			_, err := tls.LoadX509KeyPair(cfg.tls.certFile, cfg.tls.keyFile)
+			return err
+		}},
+		{name: "listen", run: func() error { return validateListenAddr(cfg) }},
+		{name: "webhooks", run: func() error { return validateWebhooks(cfg) }},
+		{name: "password_policy", run: cfg.passwordPolicy.Validate},
+		{name: "movie_rules", run: cfg.movieRules.Validate},
+		{name: "data_encryption_key", run: func() error {
+			if cfg.dataEncryptionKey == "" {
+				return nil
+			}
+			_, err := data.NewEmailCipher(cfg.dataEncryptionKey)
+			return err
+		}},
+		{name: "database_pool", run: func() error { return validateDBPool(cfg) }},
+		{name: "database", run: func() error {
+			db, err := openDB(cfg)
+			if err != nil {
+				return err
+			}
+			return db.Close()
+		}},
+		{name: "database_replicas", run: func() error {
+			replicas, err := openReplicaDBs(cfg)
+			if err != nil {
+				return err
+			}
+			for _, replica := range replicas {
+				replica.Close()
+			}
+			return nil
+		}},
+		{name: "email_templates", run: mailer.ParseTemplates},
+		{name: "smtp", run: func() error {
+			err := validateSMTP(cfg)
+			if err != nil {
+				return err
+			}
+			if cfg.smtp.disabled || cfg.smtp.host == "" {
+				return nil
+			}
+			sender, err := mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+			if err != nil {
+				return fmt.Errorf("invalid -smtp-sender: %w", err)
+			}
+			return sender.Check()
+		}},
+		{name: "cache", run: func() error {
+			switch cfg.cache.backend {
+			case "none":
+				return nil
+			case "redis":
+				cache, err := rediscache.New(cfg.cache.redisDSN, "greenlight:movies:list:", cfg.cache.ttl)
+				if err != nil {
+					return err
+				}
+				return cache.Close()
+			default:
+				return fmt.Errorf("invalid -cache value %q (must be none or redis)", cfg.cache.backend)
+			}
+		}},
+		{name: "schemas", run: func() error {
+			if !cfg.schemaValidation {
+				return nil
+			}
+			_, err := loadSchemas()
+			return err
+		}},
+	}
+
+	failed := 0
+
+	for _, check := range checks {
+		err := check.run()
+		if err != nil {
+			failed++
+			logger.PrintError(err, map[string]string{"check": check.name})
+			continue
+		}
+		logger.PrintInfo("config check passed", map[string]string{"check": check.name})
+	}
+
+	return failed
+}
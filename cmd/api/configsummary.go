@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 日志中代替密码、密钥等敏感值
+const redacted = "[REDACTED]"
+
+// summary 返回启动时记录到日志中的有效配置。密码、密钥等敏感值只记录是否设置，
+// DSN中的密码被替换掉。新增配置项时需要同时加到这里
+func (cfg config) summary() map[string]string {
+	return map[string]string{
+		"env":                   cfg.env,
+		"debug_log_bodies":      strconv.FormatBool(cfg.debugLogBodies && cfg.env == "development"),
+		"host":                  cfg.host,
+		"port":                  strconv.Itoa(cfg.port),
+		"socket":                cfg.socket,
+		"proxy_protocol":        strconv.FormatBool(cfg.proxyProtocol),
+		"tls":                   strconv.FormatBool(cfg.tls.certFile != ""),
+		"tls_redirect":          strconv.FormatBool(cfg.tls.redirect),
+		"tls_redirect_port":     strconv.Itoa(cfg.tls.redirectPort),
+		"http2":                 strconv.FormatBool(cfg.http2),
+		"grpc_port":             strconv.Itoa(cfg.grpc.port),
+		"db_dsn":                redactDSN(cfg.db.dsn),
+		"db_prepare_statements": strconv.FormatBool(cfg.db.prepareStatements),
+		"db_replicas":           strconv.Itoa(len(cfg.db.replicaDSNs)),
+		"db_max_open":           strconv.Itoa(cfg.db.maxOpenConns),
+		"db_max_idle":           strconv.Itoa(cfg.db.maxIdleConns),
+		"db_max_idle_time":      cfg.db.maxIdleTime,
+		"db_auto_migrate":       strconv.FormatBool(cfg.db.autoMigrate),
+		"db_slow_query":         cfg.db.slowQueryThreshold.String(),
+		"limiter_enabled":       strconv.FormatBool(cfg.limiter.enabled),
+		"limiter_rps":           strconv.FormatFloat(cfg.limiter.rps, 'f', -1, 64),
+		"limiter_burst":         strconv.Itoa(cfg.limiter.burst),
+		"limiter_exempt":        strconv.FormatBool(cfg.limiter.exempt),
+		"max_in_flight":         strconv.Itoa(cfg.maxInFlight),
+		"lockout_max_attempts":  strconv.Itoa(cfg.lockout.maxAttempts),
+		"lockout_window":        cfg.lockout.window.String(),
+		"verification_max_age":  cfg.verificationMaxAge.String(),
+		"smtp_disabled":         strconv.FormatBool(cfg.smtp.disabled || cfg.smtp.host == ""),
+		"smtp_host":             cfg.smtp.host,
+		"smtp_port":             strconv.Itoa(cfg.smtp.port),
+		"smtp_username":         cfg.smtp.username,
+		"smtp_password":         redactSet(cfg.smtp.password),
+		"smtp_sender":           cfg.smtp.sender,
+		"email_dedupe_window":   cfg.emails.dedupeWindow.String(),
+		"cors_trusted_origins":  strings.Join(cfg.cors.trustedOrigins, " "),
+		"cors_excluded_paths":   strings.Join(cfg.cors.excludedPaths, " "),
+		"security_headers":      strconv.FormatBool(cfg.securityHeaders.enabled),
+		"webhooks_enabled":      strconv.FormatBool(cfg.webhooks.enabled),
+		"webhooks_urls":         strconv.Itoa(len(cfg.webhooks.urls)),
+		"webhooks_secret":       redactSet(cfg.webhooks.secret),
+		"movies_max_offset":     strconv.Itoa(cfg.moviesMaxOffset),
+		"import_max_lines":      strconv.Itoa(cfg.importMaxLines),
+		"import_max_bytes":      strconv.FormatInt(cfg.importMaxBytes, 10),
+		"absolute_location":     strconv.FormatBool(cfg.absoluteLocation),
+		"movie_cache_size":      strconv.Itoa(cfg.movieCache.size),
+		"cache":                 cfg.cache.backend,
+		"cache_redis_dsn":       redactDSN(cfg.cache.redisDSN),
+		"data_encryption_key":   redactSet(cfg.dataEncryptionKey),
+		"metrics":               strconv.FormatBool(cfg.metricsEnabled),
+		"schema_validation":     strconv.FormatBool(cfg.schemaValidation),
+		"json_strict_case":      strconv.FormatBool(cfg.jsonStrictCase),
+		"otel_endpoint":         cfg.otelEndpoint,
+		"password_pwned_check":  strconv.FormatBool(cfg.pwnedCheck),
+		"cookie_name":           cfg.cookie.name,
+		"runtime_format":        cfg.runtimeFormat,
+	}
+}
+
+// 敏感值只记录是否设置
+func redactSet(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// 替换URL形式DSN中的密码，无法解析或者是key=value形式时整个替换掉
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// 定期采样连接池的状态，使用率超过阈值或者出现了等待连接的请求时记录日志，用于调整连接池的大小。
+// 在后台goroutine中运行，服务器关闭时通过app.shutdown退出
+func (app *application) monitorDBPool(db *sql.DB) {
+	app.background(func() {
+		ticker := time.NewTicker(app.config.db.statsInterval)
+		defer ticker.Stop()
+
+		previous := db.Stats()
+
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+			}
+
+			stats := db.Stats()
+
+			properties := map[string]string{
+				"in_use":               strconv.Itoa(stats.InUse),
+				"idle":                 strconv.Itoa(stats.Idle),
+				"max_open_connections": strconv.Itoa(stats.MaxOpenConnections),
+				"wait_count":           strconv.FormatInt(stats.WaitCount-previous.WaitCount, 10),
+				"wait_duration":        (stats.WaitDuration - previous.WaitDuration).String(),
+			}
+
+			// MaxOpenConnections为0表示不限制连接数，此时没有使用率可言
+			var utilization float64
+			if stats.MaxOpenConnections > 0 {
+				utilization = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+				properties["utilization"] = strconv.FormatFloat(utilization, 'f', 2, 64)
+			}
+
+			switch {
+			case stats.WaitCount > previous.WaitCount:
+				app.logger.PrintError(errors.New("database connection pool saturated: requests waited for a connection"), properties)
+			case stats.MaxOpenConnections > 0 && utilization >= app.config.db.statsErrorThreshold:
+				app.logger.PrintError(fmt.Errorf("database connection pool utilization above %.2f", app.config.db.statsErrorThreshold), properties)
+			case stats.MaxOpenConnections > 0 && utilization >= app.config.db.statsInfoThreshold:
+				app.logger.PrintInfo("database connection pool utilization high", properties)
+			}
+
+			previous = stats
+		}
+	})
+}
+
+// 检查连接池的配置：最大连接数和最大空闲连接数都必须是正数，并且空闲连接数不能超过最大连接数，
+// 否则database/sql会悄悄地把空闲连接数降到最大连接数
+func validateDBPool(cfg config) error {
+	switch {
+	case cfg.db.maxOpenConns < 1:
+		return fmt.Errorf("invalid -db-max-open-conns %d (must be at least 1)", cfg.db.maxOpenConns)
+	case cfg.db.maxIdleConns < 1:
+		return fmt.Errorf("invalid -db-max-idle-conns %d (must be at least 1)", cfg.db.maxIdleConns)
+	case cfg.db.maxIdleConns > cfg.db.maxOpenConns:
+		return fmt.Errorf("-db-max-idle-conns (%d) must not be greater than -db-max-open-conns (%d)", cfg.db.maxIdleConns, cfg.db.maxOpenConns)
+	}
+
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	if err != nil {
+		return fmt.Errorf("invalid -db-max-idle-time %q: %w", cfg.db.maxIdleTime, err)
+	}
+
+	return nil
+}
+
+// 返回PostgreSQL允许普通用户使用的连接数，即max_connections减去为超级用户保留的连接
+func dbAvailableConns(db *sql.DB) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var available int
+	err := db.QueryRowContext(ctx, `
+		SELECT current_setting('max_connections')::int - current_setting('superuser_reserved_connections')::int`).Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestValidateDBPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxOpen  int
+		maxIdle  int
+		idleTime string
+		wantErr  bool
+	}{
+		{name: "defaults", maxOpen: 25, maxIdle: 25, idleTime: "15m"},
+		{name: "fewer idle", maxOpen: 25, maxIdle: 5, idleTime: "15m"},
+		{name: "idle above open", maxOpen: 10, maxIdle: 20, idleTime: "15m", wantErr: true},
+		{name: "zero open", maxOpen: 0, maxIdle: 0, idleTime: "15m", wantErr: true},
+		{name: "negative idle", maxOpen: 10, maxIdle: -1, idleTime: "15m", wantErr: true},
+		{name: "invalid idle time", maxOpen: 10, maxIdle: 10, idleTime: "15", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.db.maxOpenConns = tt.maxOpen
+			cfg.db.maxIdleConns = tt.maxIdle
+			cfg.db.maxIdleTime = tt.idleTime
+
+			err := validateDBPool(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
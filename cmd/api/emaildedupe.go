@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// emailDeduper 记录最近发送成功的邮件，同一收件人、同一模板、同样的数据(包括其中的令牌)在窗口内只发送一次。
+// 用于发件worker：邮件已经发出但MarkSent失败，租约过期后被重新取到时不会再发一次。
+// 记录只保存在内存中，多个实例之间不共享，重启后清空
+type emailDeduper struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newEmailDeduper(window time.Duration) *emailDeduper {
+	return &emailDeduper{
+		window: window,
+		sent:   make(map[string]time.Time),
+	}
+}
+
+// 邮件的去重键。模板数据按JSON编码后参与哈希，map的键在编码时已经排好序
+func emailDedupeKey(recipient, templateFile string, templateData map[string]interface{}) (string, error) {
+	js, err := json.Marshal(templateData)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(recipient))
+	h.Write([]byte{0})
+	h.Write([]byte(templateFile))
+	h.Write([]byte{0})
+	h.Write(js)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// seen 返回窗口内是否已经发送过同样的邮件
+func (d *emailDeduper) seen(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sentAt, found := d.sent[key]
+	return found && time.Since(sentAt) < d.window
+}
+
+// record 记录一封发送成功的邮件，顺便清除过期的记录
+func (d *emailDeduper) record(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, sentAt := range d.sent {
+		if now.Sub(sentAt) >= d.window {
+			delete(d.sent, k)
+		}
+	}
+
+	d.sent[key] = now
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmailDeduper(t *testing.T) {
+	d := newEmailDeduper(time.Minute)
+
+	welcome, err := emailDedupeKey("alice@example.com", "user_welcome.tmpl", map[string]interface{}{"activationToken": "AAA", "userID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 键的顺序不影响结果
+	same, _ := emailDedupeKey("alice@example.com", "user_welcome.tmpl", map[string]interface{}{"userID": 1, "activationToken": "AAA"})
+	otherToken, _ := emailDedupeKey("alice@example.com", "user_welcome.tmpl", map[string]interface{}{"activationToken": "BBB", "userID": 1})
+
+	if welcome != same {
+		t.Error("keys for identical emails differ")
+	}
+	if welcome == otherToken {
+		t.Error("keys for different tokens are equal")
+	}
+
+	if d.seen(welcome) {
+		t.Error("email seen before it was sent")
+	}
+	d.record(welcome)
+	if !d.seen(same) {
+		t.Error("identical email not seen after it was sent")
+	}
+	if d.seen(otherToken) {
+		t.Error("email with a different token seen as duplicate")
+	}
+
+	// 窗口过后可以再次发送
+	d.sent[welcome] = time.Now().Add(-2 * time.Minute)
+	if d.seen(welcome) {
+		t.Error("email seen after the window expired")
+	}
+}
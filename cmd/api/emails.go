@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// 发送一封邮件所允许的最长时间，超过之后其他worker可以重新取到这封邮件
+const emailLease = time.Minute
+
+// -smtp-host为空时改用LogMailer，渲染后的激活令牌会被写入日志。
+// 与-seed一样，production环境下不允许这样隐式切换，必须显式设置-smtp-disabled
+func validateSMTP(cfg config) error {
+	if cfg.smtp.host == "" && !cfg.smtp.disabled && cfg.env == "production" {
+		return errors.New("-smtp-host must be set when env=production (use -smtp-disabled to write emails to the log instead)")
+	}
+	return nil
+}
+
+// 将邮件加入持久化的发送队列，由后台worker负责发送
+func (app *application) enqueueEmail(ctx context.Context, recipient, templateFile string, templateData map[string]interface{}) error {
+	email := &data.Email{
+		Recipient: recipient,
+		Template:  templateFile,
+		Data:      templateData,
+	}
+
+	return app.models.Emails.Insert(ctx, email)
+}
+
+// 启动发件worker，每隔一段时间发送队列中所有到期的邮件，服务器关闭时通过app.shutdown退出
+func (app *application) startEmailWorker() {
+	app.background(func() {
+		ticker := time.NewTicker(app.config.emails.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			app.sendQueuedEmails()
+
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// 逐封发送到期的邮件直到队列为空，每封邮件之间检查是否正在关闭服务器
+func (app *application) sendQueuedEmails() {
+	ctx := context.Background()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+
+		email, err := app.models.Emails.Claim(ctx, emailLease)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		// 窗口内已经发送过同样的邮件时直接标记为已发送
+		var dedupeKey string
+		if app.emailDedupe != nil {
+			dedupeKey, err = emailDedupeKey(email.Recipient, email.Template, email.Data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else if app.emailDedupe.seen(dedupeKey) {
+				app.logger.PrintInfo("skipping duplicate email", map[string]string{
+					"email_id": strconv.FormatInt(email.ID, 10),
+					"template": email.Template,
+				})
+
+				err = app.models.Emails.MarkSent(ctx, email.ID)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+				continue
+			}
+		}
+
+		err = app.mailer.SendContext(ctx, email.Recipient, email.Template, email.Data)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"email_id": strconv.FormatInt(email.ID, 10),
+				"template": email.Template,
+			})
+
+			// 重试间隔随尝试次数线性增加
+			backoff := time.Duration(email.Attempts) * app.config.emails.retryBackoff
+
+			err = app.models.Emails.MarkFailed(ctx, email, err, app.config.emails.maxAttempts, backoff)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+			continue
+		}
+
+		if dedupeKey != "" {
+			app.emailDedupe.record(dedupeKey)
+		}
+
+		err = app.models.Emails.MarkSent(ctx, email.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// 查看发件队列中的邮件，默认列出发送失败的邮件
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", data.EmailFailed)
+
+	filters := app.readFilters(qs, "-id", data.EmailSortSafelist, v)
+
+	v.Check(validator.In(status, data.EmailPending, data.EmailSent, data.EmailFailed), "status", "must be pending, sent or failed")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.models.Emails.GetAllByStatus(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
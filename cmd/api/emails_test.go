@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestValidateSMTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		host     string
+		disabled bool
+		wantErr  bool
+	}{
+		{name: "development without host", env: "development"},
+		{name: "production with host", env: "production", host: "smtp.example.com"},
+		{name: "production explicitly disabled", env: "production", disabled: true},
+		{name: "production without host", env: "production", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.env = tt.env
+			cfg.smtp.host = tt.host
+			cfg.smtp.disabled = tt.disabled
+
+			err := validateSMTP(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
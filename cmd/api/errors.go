@@ -1,10 +1,46 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 非标准的状态码，表示客户端在响应之前断开了连接，只用于记录日志和统计
+const statusClientClosedRequest = 499
+
+// 处理器中无法处理的错误分为三类
+const (
+	errorKindServer         = iota // 真正的服务器错误
+	errorKindClientCanceled        // 客户端断开连接，请求的context被取消
+	errorKindTimeout               // 服务器这边的超时，例如数据库查询超过了设置的时间
 )
 
+// classifyError 判断错误是否由context的取消或超时引起。lib/pq在context结束后可能返回
+// "canceling statement"错误（57014）而不是context的错误，此时根据请求的context判断是否是客户端断开了连接
+func classifyError(r *http.Request, err error) int {
+	var pqErr *pq.Error
+
+	canceled := errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &pqErr) && pqErr.Code == "57014")
+
+	switch {
+	case !canceled:
+		return errorKindServer
+	case errors.Is(r.Context().Err(), context.Canceled):
+		return errorKindClientCanceled
+	default:
+		return errorKindTimeout
+	}
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
 		"request_method": r.Method,
@@ -12,9 +48,35 @@ func (app *application) logError(r *http.Request, err error) {
 	})
 }
 
-// errorResponse 通过状态码发送JSON格式错误信息给客户端，下面的方法都复用这个模版代码
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
+// 错误响应中的code，客户端可以据此区分错误的类型，不需要匹配error中的文字。已经发布的code不能修改
+const (
+	errCodeServerError            = "SERVER_ERROR"
+	errCodeTimeout                = "TIMEOUT"
+	errCodeNotFound               = "NOT_FOUND"
+	errCodeMethodNotAllowed       = "METHOD_NOT_ALLOWED"
+	errCodeBadRequest             = "BAD_REQUEST"
+	errCodeFailedValidation       = "FAILED_VALIDATION"
+	errCodeEditConflict           = "EDIT_CONFLICT"
+	errCodeNotDeleted             = "NOT_DELETED"
+	errCodeRateLimitExceeded      = "RATE_LIMIT_EXCEEDED"
+	errCodeServerBusy             = "SERVER_BUSY"
+	errCodeAccountLocked          = "ACCOUNT_LOCKED"
+	errCodeInvalidCredentials     = "INVALID_CREDENTIALS"
+	errCodeInvalidToken           = "INVALID_AUTHENTICATION_TOKEN"
+	errCodeAuthenticationRequired = "AUTHENTICATION_REQUIRED"
+	errCodeInactiveAccount        = "INACTIVE_ACCOUNT"
+	errCodeStaleVerification      = "STALE_VERIFICATION"
+	errCodeNotPermitted           = "NOT_PERMITTED"
+	errCodeUnsupportedVersion     = "UNSUPPORTED_VERSION"
+)
+
+// errorResponseWithCode 通过状态码发送{"error": message, "code": code}格式的错误信息给客户端，code为空时省略。
+// 下面的方法都复用这个模版代码
+func (app *application) errorResponseWithCode(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
 	env := envelop{"error": message}
+	if code != "" {
+		env["code"] = code
+	}
 
 	// 使用helpers中的writeJSON方法来封装JSON响应
 	err := app.writeJSON(w, status, env, nil)
@@ -24,52 +86,96 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
-// 服务器错误，返回500
+// 服务器错误，返回500。客户端断开连接和超时不算作服务器错误，不记录错误日志
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch classifyError(r, err) {
+	case errorKindClientCanceled:
+		// 客户端已经收不到响应了，只设置状态码让metrics和追踪记录下来
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	case errorKindTimeout:
+		app.timeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponseWithCode(w, r, http.StatusInternalServerError, errCodeServerError, message)
+}
+
+// 请求在服务器规定的时间内没有完成，返回503，客户端可以稍后重试
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server could not complete your request in time, please try again later"
+	app.errorResponseWithCode(w, r, http.StatusServiceUnavailable, errCodeTimeout, message)
 }
 
 // notFoundResponse 将用来发送一个404的JSON响应
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponseWithCode(w, r, http.StatusNotFound, errCodeNotFound, message)
 }
 
 // methodNotAllowedResponse发送405方法未被允许
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponseWithCode(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message)
 }
 
 // 客户端请求错误400
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponseWithCode(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error())
 }
 
 // 验证器类型中的错误映射内容作为JSON响应体，写入422错误响应
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponseWithCode(w, r, http.StatusUnprocessableEntity, errCodeFailedValidation, errors)
 }
 
 // 返回409冲突错误响应
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponseWithCode(w, r, http.StatusConflict, errCodeEditConflict, message)
+}
+
+// 恢复一个没有被删除的movie，返回422
+func (app *application) movieNotDeletedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the movie is not deleted, there is nothing to restore"
+	app.errorResponseWithCode(w, r, http.StatusUnprocessableEntity, errCodeNotDeleted, message)
+}
+
+// Accept-Version请求头中的版本不受支持，返回406
+func (app *application) unsupportedVersionResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("unsupported Accept-Version, supported versions are %d to %d", apiVersion1, latestAPIVersion)
+	app.errorResponseWithCode(w, r, http.StatusNotAcceptable, errCodeUnsupportedVersion, message)
 }
 
 // 返回429请求过多响应
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponseWithCode(w, r, http.StatusTooManyRequests, errCodeRateLimitExceeded, message)
+}
+
+// 同时处理的请求数已达上限，返回503并让客户端稍后重试
+func (app *application) serverBusyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+
+	message := "the server is handling too many requests, please try again later"
+	app.errorResponseWithCode(w, r, http.StatusServiceUnavailable, errCodeServerBusy, message)
+}
+
+// 账户因为多次登录失败被暂时锁定，返回429并通过Retry-After告诉客户端需要等待的秒数
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "too many failed login attempts for this account, please try again later"
+	app.errorResponseWithCode(w, r, http.StatusTooManyRequests, errCodeAccountLocked, message)
 }
 
 // 401用来响应不正确的凭证信息
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponseWithCode(w, r, http.StatusUnauthorized, errCodeInvalidCredentials, message)
 }
 
 // 错误的验证信息返回401未认证响应
@@ -77,23 +183,29 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponseWithCode(w, r, http.StatusUnauthorized, errCodeInvalidToken, message)
 }
 
 // 获取资源的用户需要通过验证
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponseWithCode(w, r, http.StatusUnauthorized, errCodeAuthenticationRequired, message)
 }
 
 // 通过验证但是没有激活的用户
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponseWithCode(w, r, http.StatusForbidden, errCodeInactiveAccount, message)
+}
+
+// 邮件验证已经过期，需要重新验证
+func (app *application) staleVerificationResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must re-verify your email address to access this resource, request a verification email with POST /v1/tokens/verification"
+	app.errorResponseWithCode(w, r, http.StatusForbidden, errCodeStaleVerification, message)
 }
 
 // 没有相应权限的错误
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to accesss this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponseWithCode(w, r, http.StatusForbidden, errCodeNotPermitted, message)
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// 每种错误响应都带有稳定的code，同时保留error中的文字
+func TestErrorResponseCodes(t *testing.T) {
+	app := newTestApplication(t)
+	token := addTestUser(app)
+
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name    string
+		path    string
+		headers http.Header
+		status  int
+		code    string
+	}{
+		{name: "not found", path: "/v1/no-such-route", status: http.StatusNotFound, code: errCodeNotFound},
+		{name: "authentication required", path: "/v1/movies/1", status: http.StatusUnauthorized, code: errCodeAuthenticationRequired},
+		{name: "malformed token", path: "/v1/movies/1", headers: authHeader("short"), status: http.StatusUnauthorized, code: errCodeInvalidToken},
+		{name: "unknown token", path: "/v1/movies/1", headers: authHeader("AAAAAAAAAAAAAAAAAAAAAAAAAA"), status: http.StatusUnauthorized, code: errCodeInvalidCredentials},
+		{name: "not permitted", path: "/v1/movies/1", headers: authHeader(token), status: http.StatusForbidden, code: errCodeNotPermitted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := ts.get(t, tt.path, tt.headers)
+			if status != tt.status {
+				t.Fatalf("got status %d; want %d", status, tt.status)
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			err := json.Unmarshal([]byte(body), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Code != tt.code {
+				t.Errorf("got code %q; want %q", resp.Code, tt.code)
+			}
+			if resp.Error == "" {
+				t.Error("missing error message")
+			}
+		})
+	}
+}
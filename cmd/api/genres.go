@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// 统计类型需要展开所有movie的genres数组，代价比较高，所以将结果缓存一小段时间
+type genresCache struct {
+	mu      sync.Mutex
+	genres  []data.GenreCount
+	expires time.Time
+}
+
+// 返回缓存中的类型统计，过期时重新查询数据库
+func (app *application) cachedGenres(ctx context.Context) ([]data.GenreCount, error) {
+	app.genres.mu.Lock()
+	defer app.genres.mu.Unlock()
+
+	if app.genres.genres != nil && time.Now().Before(app.genres.expires) {
+		return app.genres.genres, nil
+	}
+
+	genres, err := app.models.Movies.GetGenres(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	app.genres.genres = genres
+	app.genres.expires = time.Now().Add(app.config.genresCacheTTL)
+
+	return genres, nil
+}
+
+// 返回所有出现过的类型以及使用次数，min_count可以过滤掉很少使用的类型
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	minCount := app.readInt(r.URL.Query(), "min_count", 1, v)
+
+	if v.Check(minCount >= 1, "min_count", "must be greater than zero"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	all, err := app.cachedGenres(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// 缓存中的切片是共享的，过滤时写入新的切片
+	genres := []data.GenreCount{}
+	for _, gc := range all {
+		if gc.Count >= minCount {
+			genres = append(genres, gc)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"github.com/graph-gophers/graphql-go"
+)
+
+// GraphQL的schema定义，解析器中的方法名与其中的字段一一对应
+//
+//go:embed graphql/schema.graphql
+var graphqlSchema string
+
+// 与REST接口的错误响应保持一致的错误信息
+var (
+	errGraphQLAuthenticationRequired = errors.New("you must be authenticated to access this resource")
+	errGraphQLInactiveAccount        = errors.New("your user account must be activated to access this resource")
+	errGraphQLNotPermitted           = errors.New("your user account doesn't have the necessary permissions to accesss this resource")
+)
+
+// 解析schema并绑定根解析器，在启动时调用一次
+func (app *application) newGraphQLSchema() (*graphql.Schema, error) {
+	return graphql.ParseSchema(graphqlSchema, &graphqlResolver{app: app})
+}
+
+// POST /v1/graphql，请求体格式为{"query": "...", "operationName": "...", "variables": {...}}
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Query != "", "query", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// 解析器通过r.Context()拿到authenticate中间件放入的用户信息
+	response := app.graphql.Exec(r.Context(), input.Query, input.OperationName, input.Variables)
+
+	// 按照GraphQL规范，没有错误时不返回errors字段
+	env := envelop{"data": response.Data}
+	if len(response.Errors) > 0 {
+		env["errors"] = response.Errors
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphqlResolver 是根解析器，对应schema中的Query类型
+type graphqlResolver struct {
+	app *application
+}
+
+// 从上下文中取出当前用户，authenticate中间件保证了它一定存在
+func (res *graphqlResolver) user(ctx context.Context) *data.User {
+	user, ok := ctx.Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// 与requirePermission中间件相同的检查顺序：先认证，再激活，最后检查权限
+func (res *graphqlResolver) requirePermission(ctx context.Context, code string) error {
+	user := res.user(ctx)
+
+	if user.IsAnonymous() {
+		return errGraphQLAuthenticationRequired
+	}
+
+	if !user.Activated {
+		return errGraphQLInactiveAccount
+	}
+
+	permissions, err := res.app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !permissions.Include(code) {
+		return errGraphQLNotPermitted
+	}
+
+	return nil
+}
+
+func (res *graphqlResolver) Movie(ctx context.Context, args struct{ ID graphql.ID }) (*movieResolver, error) {
+	err := res.requirePermission(ctx, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(string(args.ID), 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil
+	}
+
+	movie, err := res.app.models.Movies.Get(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &movieResolver{movie: movie}, nil
+}
+
+func (res *graphqlResolver) Movies(ctx context.Context, args struct {
+	Title    *string
+	Genres   *[]string
+	Page     *int32
+	PageSize *int32
+	Sort     *string
+}) (*movieListResolver, error) {
+	err := res.requirePermission(ctx, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	// 默认值与listMoviesHandler保持一致
+	title := ""
+	genres := []string{}
+	filters := data.NewFilters("id", data.MovieSortSafelist...)
+
+	if args.Title != nil {
+		title = *args.Title
+	}
+	if args.Genres != nil {
+		genres = *args.Genres
+	}
+	if args.Page != nil {
+		filters.Page = int(*args.Page)
+	}
+	if args.PageSize != nil {
+		filters.PageSize = int(*args.PageSize)
+	}
+	if args.Sort != nil {
+		filters.Sort = *args.Sort
+	}
+
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, validationError(v.Errors)
+	}
+
+	movies, metadata, err := res.app.models.Movies.GetAll(ctx, title, genres, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &movieListResolver{movies: movies, metadata: metadata}, nil
+}
+
+func (res *graphqlResolver) Me(ctx context.Context) (*userResolver, error) {
+	user := res.user(ctx)
+
+	if user.IsAnonymous() {
+		return nil, errGraphQLAuthenticationRequired
+	}
+
+	return &userResolver{user: user}, nil
+}
+
+// 将validator中的错误映射合并为一条GraphQL错误信息
+func validationError(errs map[string]string) error {
+	messages := make([]string, 0, len(errs))
+
+	for key, message := range errs {
+		messages = append(messages, key+" "+message)
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
+
+type movieResolver struct {
+	movie *data.Movie
+}
+
+func (m *movieResolver) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(m.movie.ID, 10))
+}
+
+func (m *movieResolver) Title() string {
+	return m.movie.Title
+}
+
+func (m *movieResolver) Year() int32 {
+	return m.movie.Year
+}
+
+func (m *movieResolver) Runtime() int32 {
+	return m.movie.Runtime.Minutes()
+}
+
+func (m *movieResolver) CreatedAt() string {
+	return m.movie.CreatedAt.Format(time.RFC3339)
+}
+
+func (m *movieResolver) UpdatedAt() string {
+	return m.movie.UpdatedAt.Format(time.RFC3339)
+}
+
+func (m *movieResolver) Genres() []string {
+	return m.movie.Genres
+}
+
+func (m *movieResolver) Version() int32 {
+	return m.movie.Version
+}
+
+type movieListResolver struct {
+	movies   []*data.Movie
+	metadata data.Metadata
+}
+
+func (l *movieListResolver) Movies() []*movieResolver {
+	resolvers := make([]*movieResolver, len(l.movies))
+
+	for i, movie := range l.movies {
+		resolvers[i] = &movieResolver{movie: movie}
+	}
+
+	return resolvers
+}
+
+func (l *movieListResolver) Metadata() *metadataResolver {
+	return &metadataResolver{metadata: l.metadata}
+}
+
+type metadataResolver struct {
+	metadata data.Metadata
+}
+
+func (m *metadataResolver) CurrentPage() int32 {
+	return int32(m.metadata.CurrentPage)
+}
+
+func (m *metadataResolver) PageSize() int32 {
+	return int32(m.metadata.PageSize)
+}
+
+func (m *metadataResolver) FirstPage() int32 {
+	return int32(m.metadata.FirstPage)
+}
+
+func (m *metadataResolver) LastPage() int32 {
+	return int32(m.metadata.LastPage)
+}
+
+func (m *metadataResolver) TotalRecords() int32 {
+	return int32(m.metadata.TotalRecords)
+}
+
+type userResolver struct {
+	user *data.User
+}
+
+func (u *userResolver) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(u.user.ID, 10))
+}
+
+func (u *userResolver) CreatedAt() string {
+	return u.user.CreatedAt.Format(time.RFC3339)
+}
+
+func (u *userResolver) UpdatedAt() string {
+	return u.user.UpdatedAt.Format(time.RFC3339)
+}
+
+func (u *userResolver) Name() string {
+	return u.user.Name
+}
+
+func (u *userResolver) Email() string {
+	return u.user.Email
+}
+
+func (u *userResolver) Activated() bool {
+	return u.user.Activated
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/moviepb"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 每个gRPC方法需要的权限，与REST路由上的requirePermission保持一致
+var grpcMethodPermissions = map[string]string{
+	moviepb.MovieService_GetMovie_FullMethodName:    "movies:read",
+	moviepb.MovieService_ListMovies_FullMethodName:  "movies:read",
+	moviepb.MovieService_CreateMovie_FullMethodName: "movies:write",
+	moviepb.MovieService_UpdateMovie_FullMethodName: "movies:write",
+	moviepb.MovieService_DeleteMovie_FullMethodName: "movies:delete",
+}
+
+// 创建gRPC服务器并在指定端口上开始监听，返回的服务器由serve()负责关闭
+func (app *application) serveGRPC() (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", listenAddr(app.config.host, app.config.grpc.port))
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(app.grpcAuthenticate))
+	moviepb.RegisterMovieServiceServer(srv, &movieServer{app: app})
+
+	app.logger.PrintInfo("starting gRPC server", map[string]string{
+		"addr": listener.Addr().String(),
+	})
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}()
+
+	return srv, nil
+}
+
+// 优雅地关闭gRPC服务器，超过ctx的期限后强制关闭所有连接
+func (app *application) shutdownGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
+
+// gRPC的认证拦截器，令牌通过metadata中的authorization: Bearer <token>传递，
+// 验证通过后检查用户是否激活以及是否拥有该方法所需的权限
+func (app *application) grpcAuthenticate(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "you must be authenticated to access this resource")
+	}
+
+	headerParts := strings.Split(values[0], " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	token := headerParts[1]
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+	}
+
+	user, err := app.models.Users.GetForToken(ctx, data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+		default:
+			return nil, app.grpcServerError(info.FullMethod, err)
+		}
+	}
+
+	if !user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to access this resource")
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, app.grpcServerError(info.FullMethod, err)
+	}
+
+	if !permissions.Include(grpcMethodPermissions[info.FullMethod]) {
+		return nil, status.Error(codes.PermissionDenied, "your user account doesn't have the necessary permissions to accesss this resource")
+	}
+
+	return handler(context.WithValue(ctx, userContextKey, user), req)
+}
+
+// 记录错误并返回不包含内部细节的Internal状态
+func (app *application) grpcServerError(method string, err error) error {
+	app.logger.PrintError(err, map[string]string{
+		"grpc_method": method,
+	})
+
+	return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+}
+
+// 将validator中的错误映射转换为InvalidArgument状态
+// gRPC中runtime以分钟为单位，换算成秒时超出范围的值记录为runtime字段的错误，不会溢出成一个看起来正常的时长。
+// ValidateMovie之后不会覆盖这里记录的错误
+func runtimeFromProto(v *validator.Validator, minutes int32) data.Runtime {
+	runtime, err := data.RuntimeFromMinutes(minutes)
+	if err != nil {
+		v.AddError("runtime", fmt.Sprintf("must be at most %d minutes", math.MaxInt32/60))
+	}
+
+	return runtime
+}
+
+func grpcValidationError(errs map[string]string) error {
+	messages := make([]string, 0, len(errs))
+
+	for key, message := range errs {
+		messages = append(messages, key+" "+message)
+	}
+
+	return status.Error(codes.InvalidArgument, strings.Join(messages, "; "))
+}
+
+// movieServer 通过MovieModel实现moviepb.MovieServiceServer
+type movieServer struct {
+	moviepb.UnimplementedMovieServiceServer
+	app *application
+}
+
+func (s *movieServer) GetMovie(ctx context.Context, req *moviepb.GetMovieRequest) (*moviepb.Movie, error) {
+	movie, err := s.app.models.Movies.Get(ctx, req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not found")
+		default:
+			return nil, s.app.grpcServerError(moviepb.MovieService_GetMovie_FullMethodName, err)
+		}
+	}
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) ListMovies(ctx context.Context, req *moviepb.ListMoviesRequest) (*moviepb.ListMoviesResponse, error) {
+	// 零值使用与listMoviesHandler相同的默认值
+	filters := data.NewFilters("id", data.MovieSortSafelist...)
+
+	if req.GetPage() != 0 {
+		filters.Page = int(req.GetPage())
+	}
+	if req.GetPageSize() != 0 {
+		filters.PageSize = int(req.GetPageSize())
+	}
+	if req.GetSort() != "" {
+		filters.Sort = req.GetSort()
+	}
+
+	genres := req.GetGenres()
+	if genres == nil {
+		genres = []string{}
+	}
+
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	movies, metadata, err := s.app.models.Movies.GetAll(ctx, req.GetTitle(), genres, filters)
+	if err != nil {
+		return nil, s.app.grpcServerError(moviepb.MovieService_ListMovies_FullMethodName, err)
+	}
+
+	resp := &moviepb.ListMoviesResponse{
+		Movies: make([]*moviepb.Movie, len(movies)),
+		Metadata: &moviepb.Metadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+	}
+
+	for i, movie := range movies {
+		resp.Movies[i] = movieToProto(movie)
+	}
+
+	return resp, nil
+}
+
+func (s *movieServer) CreateMovie(ctx context.Context, req *moviepb.CreateMovieRequest) (*moviepb.Movie, error) {
+	v := validator.New()
+
+	movie := &data.Movie{
+		Title:   req.GetTitle(),
+		Year:    req.GetYear(),
+		Runtime: runtimeFromProto(v, req.GetRuntime()),
+		Genres:  req.GetGenres(),
+	}
+
+	if data.ValidateMovie(v, movie, s.app.config.movieRules); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	err := s.app.models.Movies.Insert(ctx, movie)
+	if err != nil {
+		return nil, s.app.grpcServerError(moviepb.MovieService_CreateMovie_FullMethodName, err)
+	}
+
+	s.app.invalidateListingCache()
+	s.app.publishEvent(webhook.EventMovieCreated, movie)
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) UpdateMovie(ctx context.Context, req *moviepb.UpdateMovieRequest) (*moviepb.Movie, error) {
+	movie, err := s.app.models.Movies.GetForUpdate(ctx, req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not found")
+		default:
+			return nil, s.app.grpcServerError(moviepb.MovieService_UpdateMovie_FullMethodName, err)
+		}
+	}
+
+	v := validator.New()
+
+	// 只更新请求中设置了的字段
+	if req.Title != nil {
+		movie.Title = req.GetTitle()
+	}
+	if req.Year != nil {
+		movie.Year = req.GetYear()
+	}
+	if req.Runtime != nil {
+		movie.Runtime = runtimeFromProto(v, req.GetRuntime())
+	}
+	if len(req.GetGenres()) > 0 {
+		movie.Genres = req.GetGenres()
+	}
+
+	if data.ValidateMovie(v, movie, s.app.config.movieRules); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	// grpcAuthenticate已经将通过认证的用户放入ctx
+	user := ctx.Value(userContextKey).(*data.User)
+
+	err = s.app.models.Movies.Update(ctx, movie, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+		default:
+			return nil, s.app.grpcServerError(moviepb.MovieService_UpdateMovie_FullMethodName, err)
+		}
+	}
+
+	s.app.invalidateListingCache()
+	s.app.publishEvent(webhook.EventMovieUpdated, movie)
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) DeleteMovie(ctx context.Context, req *moviepb.DeleteMovieRequest) (*moviepb.DeleteMovieResponse, error) {
+	err := s.app.models.Movies.Delete(ctx, req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not found")
+		default:
+			return nil, s.app.grpcServerError(moviepb.MovieService_DeleteMovie_FullMethodName, err)
+		}
+	}
+
+	s.app.invalidateListingCache()
+	s.app.publishEvent(webhook.EventMovieDeleted, envelop{"id": req.GetId()})
+
+	return &moviepb.DeleteMovieResponse{}, nil
+}
+
+func movieToProto(movie *data.Movie) *moviepb.Movie {
+	return &moviepb.Movie{
+		Id:      movie.ID,
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime.Minutes(),
+		Genres:  movie.Genres,
+		Version: movie.Version,
+	}
+}
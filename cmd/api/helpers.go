@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/LTXWorld/greenLight_copy/internal/data"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
 	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 )
@@ -33,8 +39,14 @@ type envelop map[string]interface{}
 
 // 用来将数据写成JSON格式返回给用户，包括了状态码，要传输的被封装过的数据，http头部的map包括任何想要在这个响应中添加的http头部
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelop, headers http.Header) error {
-	// Encode the data to JSON，使用MarshalIndent增加空格，使格式更好看
-	js, err := json.MarshalIndent(data, "", "\t")
+	// Encode the data to JSON，开启了-json-pretty时使用MarshalIndent增加空格，使格式更好看
+	var js []byte
+	var err error
+	if app.config.jsonPretty {
+		js, err = json.MarshalIndent(data, "", "\t")
+	} else {
+		js, err = json.Marshal(data)
+	}
 	if err != nil {
 		return err
 	}
@@ -56,14 +68,85 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// writeJSONStream 与writeJSON相同，但是直接将JSON编码到ResponseWriter中，不在内存中缓存整个响应体，适合较大的列表响应。
+// 代价是状态码和响应头在编码之前就已经发送出去了，编码中途出错时无法再改成500响应，只能记录错误；
+// 需要在出错时返回错误响应的小响应仍然应该使用writeJSON
+func (app *application) writeJSONStream(w http.ResponseWriter, status int, data envelop, headers http.Header) error {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// Encode会在末尾加上换行符，与writeJSON的输出保持一致
+	enc := json.NewEncoder(w)
+	if app.config.jsonPretty {
+		enc.SetIndent("", "\t")
+	}
+
+	return enc.Encode(data)
+}
+
+// 请求头中是否包含Prefer: return=minimal，Prefer可以出现多次，每个值也可以包含多个逗号分隔的偏好
+func prefersMinimal(r *http.Request) bool {
+	for _, line := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeJSONOrMinimal 用于写操作的响应：客户端要求return=minimal时只返回204和响应头，否则与writeJSON相同
+func (app *application) writeJSONOrMinimal(w http.ResponseWriter, r *http.Request, status int, data envelop, headers http.Header) error {
+	if !prefersMinimal(r) {
+		return app.writeJSON(w, status, data, headers)
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Preference-Applied", "return=minimal")
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
 // 读取JSON格式的请求体并返回其中可能发生的所有关于JSON的错误情况的信息
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	// Use http.MaxBytesReader() 去限制请求体的大小1MB
 	maxBytes := 1_048_576
+
+	// Content-Length已经超过限制时不用读取请求体就可以拒绝。长度未知时ContentLength为-1，
+	// 客户端也可能谎报长度，所以仍然由下面的MaxBytesReader来保证上限
+	if r.ContentLength > int64(maxBytes) {
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	}
+
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
+	// 检查键的大小写需要再解析一次请求体，所以先把请求体全部读出来
+	var body io.Reader = r.Body
+	var raw []byte
+	if app.config.jsonStrictCase {
+		var err error
+		raw, err = io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+			}
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
 	// 初始化json.Decoder，调用DisallowUnknownFields方法在反序列化之前，防止请求体中的数据存在无法映射的属性
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	// 反序列化请求体到目标位置
@@ -121,6 +204,12 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	if err != io.EOF {
 		return errors.New("body must only contain a single JSON value")
 	}
+
+	// 开启-json-strict-case时键的大小写必须与文档中的完全一致
+	if app.config.jsonStrictCase {
+		return checkJSONFieldCase(raw, reflect.TypeOf(dst))
+	}
+
 	return nil
 }
 
@@ -138,15 +227,19 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 
 // 读取一个字符串值，然后在逗号字符处将其拆分为一个切片
 func (app *application) readCSV(qs url.Values, key string, defaultValue []string) []string {
+	return app.readDelimited(qs, key, ",", defaultValue)
+}
+
+// 与readCSV相同，但是使用指定的分隔符拆分，分隔符可以是多个字符，值本身包含逗号时使用
+func (app *application) readDelimited(qs url.Values, key string, sep string, defaultValue []string) []string {
 	// Extract the value from the query string
-	csv := qs.Get(key)
+	s := qs.Get(key)
 
-	if csv == "" {
+	if s == "" {
 		return defaultValue
 	}
 
-	//
-	return strings.Split(csv, ",")
+	return strings.Split(s, sep)
 }
 
 // 从query字符串中读取一个字符串值，将其转换为整数返回，如果转换不成，那么记录Validator错误
@@ -168,14 +261,150 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// 读取列表接口共用的page，page_size和sort参数，转换失败时记录Validator错误。
+// 调用方仍然需要用data.ValidateFilters检查取值范围和排序字段，所有列表接口的分页参数因此保持一致
+func (app *application) readFilters(qs url.Values, defaultSort string, safelist []string, v *validator.Validator) data.Filters {
+	filters := data.NewFilters(defaultSort, safelist...)
+	filters.Page = app.readInt(qs, "page", filters.Page, v)
+	filters.PageSize = app.readInt(qs, "page_size", filters.PageSize, v)
+	filters.Sort = app.readString(qs, "sort", filters.Sort)
+
+	return filters
+}
+
+// 从query字符串中读取一个布尔值，没有这个key时返回nil，表示不按这个条件过滤；
+// 无法转换时记录Validator错误
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+
+	return &b
+}
+
+// 向Vary响应头中追加请求头名称，已经存在的（不区分大小写）不会重复添加，
+// 所有值合并为一个逗号分隔的Vary头
+func addVary(h http.Header, names ...string) {
+	var values []string
+	seen := make(map[string]bool)
+
+	for _, line := range h.Values("Vary") {
+		for _, value := range strings.Split(line, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" || seen[strings.ToLower(value)] {
+				continue
+			}
+			seen[strings.ToLower(value)] = true
+			values = append(values, value)
+		}
+	}
+
+	for _, name := range names {
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		values = append(values, name)
+	}
+
+	h.Set("Vary", strings.Join(values, ", "))
+}
+
+// 返回客户端的真实IP地址。开启了-proxy-protocol时RemoteAddr已经是PROXY头中的地址，
+// 负载均衡器不会修改HTTP头，请求头中的X-Forwarded-For等都来自客户端，不可信；
+// 否则由于设置了反向代理，使用realip.FromRequest从请求头中获取
+func (app *application) clientIP(r *http.Request) string {
+	if !app.config.proxyProtocol {
+		return realip.FromRequest(r)
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// 返回Location头中使用的地址。开启-absolute-location时在path前面加上请求的scheme和主机名，
+// 与clientIP相同，没有开启-proxy-protocol时认为前面是反向代理，使用X-Forwarded-Proto和X-Forwarded-Host
+func (app *application) locationURL(r *http.Request, path string) string {
+	if !app.config.absoluteLocation {
+		return path
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if !app.config.proxyProtocol {
+		// 经过多层代理时取第一个值，即最靠近客户端的代理设置的值
+		if proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); proto != "" {
+			proto = strings.ToLower(strings.TrimSpace(proto))
+			if proto == "http" || proto == "https" {
+				scheme = proto
+			}
+		}
+		if fwdHost, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); strings.TrimSpace(fwdHost) != "" {
+			host = strings.TrimSpace(fwdHost)
+		}
+	}
+
+	u := url.URL{Scheme: scheme, Host: host, Path: path}
+	return u.String()
+}
+
+// 生成前端激活页面的链接，没有配置-frontend-base-url时返回空字符串，邮件模版中据此决定是否显示链接
+func (app *application) activationURL(token string) string {
+	if app.config.frontendBaseURL == "" {
+		return ""
+	}
+	return app.config.frontendBaseURL + "/activate?token=" + url.QueryEscape(token)
+}
+
+// 与activationURL相同，用于重新验证邮件地址的链接
+func (app *application) verificationURL(token string) string {
+	if app.config.frontendBaseURL == "" {
+		return ""
+	}
+	return app.config.frontendBaseURL + "/verify?token=" + url.QueryEscape(token)
+}
+
+// 启用了-password-pwned-check时检查密码是否已经泄露，注册和修改密码时使用。
+// 外部服务出错时只记录日志并放行，不影响用户注册
+func (app *application) checkBreachedPassword(r *http.Request, v *validator.Validator, password string) {
+	if app.pwned == nil {
+		return
+	}
+
+	count, err := app.pwned.Breached(r.Context(), password)
+	if err != nil {
+		app.logError(r, fmt.Errorf("pwned password check failed: %w", err))
+		return
+	}
+
+	v.Check(count == 0, "password", "has appeared in a data breach, please choose a different password")
+}
+
 // 用来包装关于goroutine的panic recover逻辑,并使用WaitGroup进行处理后台goroutine的关闭
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter
 	app.wg.Add(1)
+	app.backgroundTasks.Add(1)
 
 	// Launch a background goroutine
 	go func() {
 		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
 		// Recover any panic
 		defer func() {
 			if err := recover(); err != nil {
@@ -187,3 +416,20 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// 等待所有后台任务结束，ctx到期时不再等待，返回仍在运行的任务数
+func (app *application) waitBackground(ctx context.Context) int64 {
+	done := make(chan struct{})
+
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return app.backgroundTasks.Load()
+	}
+}
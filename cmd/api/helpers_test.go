@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+func TestReadDelimited(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name  string
+		query string
+		sep   string
+		want  []string
+	}{
+		{name: "default comma", query: "genres=drama,action", sep: ",", want: []string{"drama", "action"}},
+		{name: "pipe keeps commas", query: "genres=" + url.QueryEscape("Adventure, Action|drama"), sep: "|", want: []string{"Adventure, Action", "drama"}},
+		{name: "multi-char separator", query: "genres=drama::action::sci-fi", sep: "::", want: []string{"drama", "action", "sci-fi"}},
+		{name: "separator not present", query: "genres=drama,action", sep: "|", want: []string{"drama,action"}},
+		{name: "missing key", query: "title=moana", sep: ",", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := app.readDelimited(qs, "genres", tt.sep, []string{})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// readCSV仍然使用逗号
+	qs := url.Values{"genres": {"drama,action"}}
+	if got := app.readCSV(qs, "genres", nil); !reflect.DeepEqual(got, []string{"drama", "action"}) {
+		t.Errorf("readCSV got %q", got)
+	}
+}
+
+func TestReadBool(t *testing.T) {
+	app := &application{}
+
+	v := validator.New()
+	qs := url.Values{"activated": {"false"}, "bad": {"maybe"}}
+
+	if got := app.readBool(qs, "activated", v); got == nil || *got {
+		t.Errorf("got %v; want false", got)
+	}
+	if got := app.readBool(qs, "missing", v); got != nil {
+		t.Errorf("got %v for a missing key; want nil", *got)
+	}
+	if !v.Valid() {
+		t.Fatalf("unexpected errors %v", v.Errors)
+	}
+
+	app.readBool(qs, "bad", v)
+	if _, ok := v.Errors["bad"]; !ok {
+		t.Errorf("expected an error for an invalid value, got %v", v.Errors)
+	}
+}
+
+func TestLocationURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		absolute      bool
+		proxyProtocol bool
+		headers       map[string]string
+		want          string
+	}{
+		{name: "relative by default", want: "/v1/movies/1"},
+		{name: "absolute", absolute: true, want: "http://api.example.com/v1/movies/1"},
+		{name: "forwarded headers", absolute: true, headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "movies.example.com"}, want: "https://movies.example.com/v1/movies/1"},
+		{name: "first forwarded value", absolute: true, headers: map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "movies.example.com, internal:8080"}, want: "https://movies.example.com/v1/movies/1"},
+		{name: "invalid forwarded proto", absolute: true, headers: map[string]string{"X-Forwarded-Proto": "javascript"}, want: "http://api.example.com/v1/movies/1"},
+		{name: "forwarded headers ignored with proxy protocol", absolute: true, proxyProtocol: true, headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, want: "http://api.example.com/v1/movies/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.absoluteLocation = tt.absolute
+			app.config.proxyProtocol = tt.proxyProtocol
+
+			r := httptest.NewRequest(http.MethodPost, "http://api.example.com/v1/movies", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			got := app.locationURL(r, "/v1/movies/1")
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSONStrictCase(t *testing.T) {
+	type credit struct {
+		Name string `json:"name"`
+	}
+	type input struct {
+		Title   *string        `json:"title"`
+		Runtime *data.Runtime  `json:"runtime"`
+		Genres  []string       `json:"genres"`
+		Credits []credit       `json:"credits"`
+		Extra   map[string]int `json:"extra"`
+	}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		body    string
+		wantErr string
+	}{
+		{name: "lax accepts mismatched case", body: `{"Title": "Moana"}`},
+		{name: "exact case", strict: true, body: `{"title": "Moana", "runtime": "107 mins", "genres": ["Animation"], "credits": [{"name": "Auli'i"}], "extra": {"Any": 1}}`},
+		{name: "mismatched top-level key", strict: true, body: `{"Title": "Moana"}`, wantErr: `body contains unknown key "Title"`},
+		{name: "mismatched nested key", strict: true, body: `{"credits": [{"NAME": "Auli'i"}]}`, wantErr: `body contains unknown key "NAME"`},
+		{name: "unknown key", strict: true, body: `{"director": "Ron Clements"}`, wantErr: `"director"`},
+		{name: "syntax error reported first", strict: true, body: `{"Title": }`, wantErr: "body contains badly-formed JSON (at character 11)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.jsonStrictCase = tt.strict
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(tt.body))
+			var dst input
+
+			err := app.readJSON(httptest.NewRecorder(), r, &dst)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("got error %v; want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
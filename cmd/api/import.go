@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+)
+
+// 每一行导入失败的原因，errors与其他接口的422响应格式相同
+type importLineError struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// 通过换行分隔的JSON(ND-JSON)批量导入movie，每一行是一个与createMovieHandler请求体相同的对象。
+// 逐行读取并插入，不会把整个请求体读入内存；某一行出错不影响其他行，最后返回每一行的错误以及行号
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	// 单行的限制之外再限制整个请求体的大小，否则最多可以接受importMaxLines个1MB的行
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.importMaxBytes)
+
+	scanner := bufio.NewScanner(r.Body)
+	// 单行最大1MB，与readJSON的限制一致
+	scanner.Buffer(make([]byte, 0, 64*1024), 1_048_576)
+
+	imported := 0
+	lineErrors := []importLineError{}
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if lineNumber > app.config.importMaxLines {
+			lineErrors = append(lineErrors, importLineError{
+				Line:   lineNumber,
+				Errors: map[string]string{"body": fmt.Sprintf("must not contain more than %d lines", app.config.importMaxLines)},
+			})
+			break
+		}
+
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			lineErrors = append(lineErrors, importLineError{
+				Line:   lineNumber,
+				Errors: map[string]string{"body": err.Error()},
+			})
+			continue
+		}
+
+		movie := &data.Movie{
+			Title:   input.Title,
+			Year:    input.Year,
+			Runtime: input.Runtime,
+			Genres:  input.Genres,
+		}
+
+		v := validator.New()
+
+		if data.ValidateMovie(v, movie, app.config.movieRules); !v.Valid() {
+			lineErrors = append(lineErrors, importLineError{Line: lineNumber, Errors: v.Errors})
+			continue
+		}
+
+		err = app.models.Movies.Insert(r.Context(), movie)
+		if err != nil {
+			if imported > 0 {
+				app.invalidateListingCache()
+			}
+			app.importFailedResponse(w, r, err, imported)
+			return
+		}
+
+		imported++
+		app.publishEvent(webhook.EventMovieCreated, movie)
+	}
+
+	if imported > 0 {
+		app.invalidateListingCache()
+	}
+
+	// 读取请求体出错（例如某一行超过了1MB）时，已经导入的行保持不变，错误记录在最后一行
+	if err := scanner.Err(); err != nil {
+		message := err.Error()
+
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			message = fmt.Sprintf("body must not be larger than %d bytes", app.config.importMaxBytes)
+		}
+
+		lineErrors = append(lineErrors, importLineError{
+			Line:   lineNumber + 1,
+			Errors: map[string]string{"body": message},
+		})
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelop{"imported": imported, "errors": lineErrors}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 插入出错时已经导入的行不会回滚，500响应中同时返回已经导入的数量，客户端可以据此跳过这些行重试
+func (app *application) importFailedResponse(w http.ResponseWriter, r *http.Request, err error, imported int) {
+	app.logError(r, err)
+
+	env := envelop{
+		"error":    "the server encountered a problem and could not process your request",
+		"code":     errCodeServerError,
+		"imported": imported,
+	}
+
+	err = app.writeJSON(w, http.StatusInternalServerError, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
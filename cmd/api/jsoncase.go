@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkJSONFieldCase 检查body中对象的键与t中字段的JSON名字大小写是否完全一致。
+// encoding/json匹配字段名时不区分大小写，无法配置，所以开启-json-strict-case时在解码成功之后再检查一遍，
+// 大小写不一致的键与DisallowUnknownFields一样作为未知的键返回错误。
+// 自己实现了反序列化的类型(例如Runtime)和map由它们自己处理，不检查
+func checkJSONFieldCase(body []byte, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) || reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(body, &object) != nil {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		for key, value := range object {
+			field, ok := fields[key]
+			if !ok {
+				// 大小写不同但是能被encoding/json匹配上的键
+				for name := range fields {
+					if strings.EqualFold(name, key) {
+						return fmt.Errorf("body contains unknown key %q", key)
+					}
+				}
+				continue
+			}
+
+			err := checkJSONFieldCase(value, field)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		var elements []json.RawMessage
+		if json.Unmarshal(body, &elements) != nil {
+			return nil
+		}
+
+		for _, element := range elements {
+			err := checkJSONFieldCase(element, t.Elem())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 返回结构体中所有可以被反序列化的字段，键是JSON中的名字，嵌入结构体的字段被展开
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for embeddedName, embeddedType := range jsonFields(ft) {
+					if _, exists := fields[embeddedName]; !exists {
+						fields[embeddedName] = embeddedType
+					}
+				}
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+
+	return fields
+}
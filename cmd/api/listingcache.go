@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// 列表缓存的命中和未命中次数，在-cache=redis时发布
+var (
+	listingCacheHits   = new(expvar.Int)
+	listingCacheMisses = new(expvar.Int)
+)
+
+// 从缓存中读取GET /v1/movies的响应，键为规范化后的查询字符串。
+// 返回的gen需要在写回缓存时使用；Redis出错时只记录日志，当作未命中处理
+func (app *application) cachedListing(r *http.Request) (envelop, int64, bool) {
+	if app.listingCache == nil {
+		return nil, 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	gen, err := app.listingCache.Generation(ctx)
+	if err != nil {
+		app.logError(r, err)
+		return nil, 0, false
+	}
+
+	js, found, err := app.listingCache.Get(ctx, gen, app.listingCacheKey(r))
+	if err != nil {
+		app.logError(r, err)
+		return nil, gen, false
+	}
+
+	if !found {
+		listingCacheMisses.Add(1)
+		return nil, gen, false
+	}
+
+	var cached map[string]json.RawMessage
+
+	err = json.Unmarshal(js, &cached)
+	if err != nil {
+		app.logError(r, err)
+		return nil, gen, false
+	}
+
+	listingCacheHits.Add(1)
+
+	env := envelop{}
+	for key, value := range cached {
+		env[key] = value
+	}
+
+	return env, gen, true
+}
+
+// 缓存键为规范化后的查询字符串，不同版本的响应格式不同，版本1以外的加上版本前缀
+func (app *application) listingCacheKey(r *http.Request) string {
+	key := r.URL.Query().Encode()
+	if version := app.contextGetAPIVersion(r); version != apiVersion1 {
+		key = fmt.Sprintf("v%d:%s", version, key)
+	}
+
+	return key
+}
+
+// 将列表响应写入缓存，gen必须是查询数据库之前通过cachedListing得到的代数
+func (app *application) cacheListing(r *http.Request, gen int64, env envelop) {
+	if app.listingCache == nil {
+		return
+	}
+
+	js, err := json.Marshal(env)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	err = app.listingCache.Set(ctx, gen, app.listingCacheKey(r), js)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// 任何movie的创建，更新，删除之后调用，使所有缓存的列表响应失效
+func (app *application) invalidateListingCache() {
+	if app.listingCache == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := app.listingCache.Invalidate(ctx)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginLimiter 按邮件地址和客户端IP记录连续失败的登录次数，超过上限后在一个时间窗口内锁定该IP对这个账户的认证。
+// 计数不论账户是否存在，这样不存在的地址与存在的地址得到相同的响应；
+// 按(邮件, IP)计数，知道邮件地址的人只能锁住自己，不能让账户的主人无法登录
+type loginLimiter struct {
+	maxAttempts int
+	window      time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]*loginAttempt
+}
+
+// 单个(邮件, IP)的失败记录
+type loginAttempt struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+// newLoginLimiter 返回一个新的loginLimiter，并启动后台协程定期清除过期的记录
+func newLoginLimiter(maxAttempts int, window time.Duration) *loginLimiter {
+	l := &loginLimiter{
+		maxAttempts: maxAttempts,
+		window:      window,
+		attempts:    make(map[string]*loginAttempt),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			l.mu.Lock()
+			for key, attempt := range l.attempts {
+				if time.Since(attempt.firstFailed) > l.window && time.Now().After(attempt.lockedUntil) {
+					delete(l.attempts, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+// 记录的键，邮件地址不区分大小写
+func loginAttemptKey(email, ip string) string {
+	return strings.ToLower(email) + " " + ip
+}
+
+// lockedFor 返回该IP对这个邮件地址剩余的锁定时长，没有被锁定时返回0
+func (l *loginLimiter) lockedFor(email, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	attempt, found := l.attempts[loginAttemptKey(email, ip)]
+	if !found {
+		return 0
+	}
+
+	if remaining := time.Until(attempt.lockedUntil); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// fail 记录一次失败的登录，在窗口内达到maxAttempts次后锁定该IP对这个账户的认证window时长
+func (l *loginLimiter) fail(email, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := loginAttemptKey(email, ip)
+
+	attempt, found := l.attempts[key]
+	// 第一次失败或者已经超出了统计窗口，重新开始计数
+	if !found || time.Since(attempt.firstFailed) > l.window {
+		attempt = &loginAttempt{firstFailed: time.Now()}
+		l.attempts[key] = attempt
+	}
+
+	attempt.failures++
+
+	if attempt.failures >= l.maxAttempts {
+		attempt.lockedUntil = time.Now().Add(l.window)
+		attempt.failures = 0
+		attempt.firstFailed = time.Now()
+	}
+}
+
+// reset 登录成功后清除该IP对这个邮件地址的失败记录
+func (l *loginLimiter) reset(email, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, loginAttemptKey(email, ip))
+}
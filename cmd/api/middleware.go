@@ -7,7 +7,6 @@ import (
 	"github.com/LTXWorld/greenLight_copy/internal/data"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
 	"github.com/felixge/httpsnoop"
-	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"net/http"
 	"strconv"
@@ -29,112 +28,218 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-// rateLimit限流中间件
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	// 定义一个client结构体用于记录客户端的limiter和最后出现时间
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// ipLimiter 在内存中为每个客户端IP保存一个令牌桶
+type ipLimiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*ipLimiterClient
+}
 
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters&time
-	// 内存中的速率限制器映射:客户端IP为键，客户端为值
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+// 定义一个client结构体用于记录客户端的limiter和最后出现时间
+type ipLimiterClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPLimiter 返回一个新的ipLimiter，并启动后台协程移除三分钟内没有出现过的客户端
+func newIPLimiter(rps float64, burst int) *ipLimiter {
+	l := &ipLimiter{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*ipLimiterClient),
+	}
 
-	// Launch a background goroutine which removes old entries from the clients map every minute
-	// 启用一个后台协程移除旧的键值对
 	go func() {
 		for {
 			time.Sleep(time.Minute)
-			// 后台Goroutine删除时会不会影响正在运行的后面的其他逻辑？
-			mu.Lock()
 
-			// Loop through all clients. If they haven't been seen within the last three minutes
-			// delete the corresponding entry
-			for ip, client := range clients {
+			l.mu.Lock()
+			for ip, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip) // 从clients map中删除指定ip的entry
+					delete(l.clients, ip)
 				}
 			}
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
+	return l
+}
+
+// 返回ip对应的令牌桶，不存在时创建
+func (l *ipLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, found := l.clients[ip]
+	if !found {
+		client = &ipLimiterClient{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+
+	return client.limiter
+}
+
+// allow 消耗ip的一个令牌，没有剩余令牌时返回false
+func (l *ipLimiter) allow(ip string) bool {
+	return l.get(ip).Allow()
+}
+
+// exhausted 报告ip当前是否已经没有令牌，不消耗令牌
+func (l *ipLimiter) exhausted(ip string) bool {
+	return l.get(ip).Tokens() < 1
+}
+
+// rateLimit限流中间件，按客户端IP限制请求速率
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	limiter := newIPLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled
-		if app.config.limiter.enabled {
-			// host,port,error,从请求地址中提取IP地址，由于设置了反向代理，使用realip.FromRequest
-			// 从请求头中获取客户端的真实IP地址
-			ip := realip.FromRequest(r)
-
-			mu.Lock() // 下面这段代码互斥进行，不能多个请求同时访问map
-
-			// 检查ip是否已经存在于这个map中(ip-client),对map的一种断言判断
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					// 不再硬编码，而是使用main config内的
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-			}
+		// 每当调用Allow都会消耗一个令牌，如果没有剩余令牌就会返回false
+		if app.config.limiter.enabled && !limiter.allow(app.clientIP(r)) && !app.rateLimitExempt(r) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
 
-			clients[ip].lastSeen = time.Now()
-			// 每当调用Allow都会消耗一个令牌，如果没有剩余令牌就会返回false，Allow底层有锁保持互斥
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
-			}
-			mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 限制同时处理的请求数。与按IP限制速率的rateLimit不同，它保护的是连接池和内存这些全局的资源。
+// 信号量已满时不排队，直接返回503；健康检查不受限制，负载高的时候也能正常响应。
+// WebSocket连接会一直保持，同样不占用名额，否则几个长连接就能占满所有名额
+func (app *application) limitInFlight(next http.Handler) http.Handler {
+	if app.config.maxInFlight <= 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, app.config.maxInFlight)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/healthcheck" || r.URL.Path == "/v1/ws" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		default:
+			app.serverBusyResponse(w, r)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// 超过限流的请求是否可以放行。只在开启-limiter-exempt时检查，此时rateLimit在authenticate之后，
+// 上下文中已经有用户。只在超过限制时才查询权限，没有超过限制的请求不增加数据库查询
+func (app *application) rateLimitExempt(r *http.Request) bool {
+	if !app.config.limiter.exempt {
+		return false
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r, err)
+		return false
+	}
+
+	return permissions.Include("ratelimit:exempt")
+}
+
 // 通过用户传来的JSON请求中的Authorization头字段验证用户信息，并将用户信息加入到请求上下文中
 func (app *application) authenticate(next http.Handler) http.Handler {
+	return app.authenticateLimited(nil, next)
+}
+
+// authenticateLimited 与authenticate相同，failures不为nil时按IP限制认证失败的次数。
+// 开启-limiter-exempt时限流放在认证之后，认证失败的请求到不了rateLimit，由这里限流：
+// 失败会消耗一个令牌，令牌用完之后直接返回429，不再查询数据库
+func (app *application) authenticateLimited(failures *ipLimiter, next http.Handler) http.Handler {
+	limited := failures != nil && app.config.limiter.enabled
+
+	// 认证失败时先消耗令牌，令牌用完时返回429而不是respond的响应
+	fail := func(w http.ResponseWriter, r *http.Request, respond func(http.ResponseWriter, *http.Request)) {
+		if limited && !failures.allow(app.clientIP(r)) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		respond(w, r)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 向 HTTP 响应中添加一个 Vary: Authorization 响应头，
 		// 它的主要作用是向任何缓存服务器或代理服务器说明，响应的内容可能会因为请求中 Authorization 请求头的不同而变化
 		// 只有当请求的 Authorization 头的值相同，缓存才可以重复使用相同的响应。否则，缓存服务器应该认为它们是不同的请求
-		w.Header().Add("Vary", "Authorization")
+		addVary(w.Header(), "Authorization")
 
 		// 从请求的验证头中获取对应值
 		authorizationHeader := r.Header.Get("Authorization")
 
-		// 如果没有Authorization字段，将匿名用户加入到请求上下文中并不执行下面任何代码
-		if authorizationHeader == "" {
+		var token string
+
+		switch {
+		case authorizationHeader != "":
+			// "Bearer <token>"格式
+			headerParts := strings.Split(authorizationHeader, " ")
+			if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+				fail(w, r, app.invalidCredentialsResponse)
+				return
+			}
+
+			// Extract the actual authentication token from the header parts
+			token = headerParts[1]
+		case websocketToken(r) != "":
+			// 浏览器无法为WebSocket请求设置Authorization头，令牌放在子协议中
+			token = websocketToken(r)
+		case app.config.cookie.name != "":
+			// 没有Authorization头时，再尝试从配置的cookie中读取令牌
+			addVary(w.Header(), "Cookie")
+
+			cookie, err := r.Cookie(app.config.cookie.name)
+			if err == nil {
+				token = cookie.Value
+			}
+		}
+
+		// 如果没有任何令牌，将匿名用户加入到请求上下文中并不执行下面任何代码
+		if token == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// "Bearer <token>"格式
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidCredentialsResponse(w, r)
+		// 这个IP认证失败的次数已经用完，不再为它查询数据库
+		if limited && failures.exhausted(app.clientIP(r)) {
+			app.rateLimitExceededResponse(w, r)
 			return
 		}
 
-		// Extract the actual authentication token from the header parts
-		token := headerParts[1]
-
 		v := validator.New()
 
 		// 验证token是否有效
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+			fail(w, r, app.invalidAuthenticationTokenResponse)
 			return
 		}
 
 		// 根据有效的token从数据库中进行检索用户信息
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidCredentialsResponse(w, r)
+				fail(w, r, app.invalidCredentialsResponse)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
@@ -183,21 +288,44 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// 用于高敏感操作（如删除账户），要求用户在最近maxAge时间内验证过邮件
+func (app *application) requireRecentVerification(maxAge time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.VerifiedWithin(maxAge) {
+			app.staleVerificationResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
 // 检查所给的权限是否在当前用户的权限列表中
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requirePermissions(next, code)
+}
+
+// 要求用户同时拥有所有给定的权限，权限列表只从数据库读取一次
+func (app *application) requirePermissions(next http.HandlerFunc, codes ...string) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		// 检查所给的权限是否在当前用户的权限列表中
-		if !permissions.Include(code) {
-			app.notPermittedResponse(w, r)
-			return
+		// 检查所给的权限是否都在当前用户的权限列表中
+		for _, code := range codes {
+			if !permissions.Include(code) {
+				app.notPermittedResponse(w, r)
+				return
+			}
 		}
 
 		next.ServeHTTP(w, r)
@@ -206,15 +334,52 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// 为所有响应设置安全相关的响应头，放在enableCORS外面，预检请求和错误响应也会带上
+func (app *application) securityHeaders(next http.Handler) http.Handler {
+	cfg := app.config.securityHeaders
+
+	// 响应头在启动后不会变化，提前计算好
+	headers := make(http.Header)
+	if cfg.enabled {
+		headers.Set("X-Content-Type-Options", "nosniff")
+		if cfg.frameOptions != "" {
+			headers.Set("X-Frame-Options", cfg.frameOptions)
+		}
+		if cfg.referrerPolicy != "" {
+			headers.Set("Referrer-Policy", cfg.referrerPolicy)
+		}
+		if cfg.contentSecurityPolicy != "" {
+			headers.Set("Content-Security-Policy", cfg.contentSecurityPolicy)
+		}
+		// 通过明文HTTP发送的HSTS会被浏览器忽略，所以只在开启TLS时发送
+		if app.config.tls.certFile != "" && cfg.hstsMaxAge > 0 {
+			headers.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.hstsMaxAge.Seconds())))
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range headers {
+			w.Header()[key] = values
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // 使浏览器允许跨域请求的接收
 // app有一个来自于命令行设置的信任列表，其他源根据自己的源来判断是否匹配这个信任列表，并填充响应体
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add the "Vary: Origin" header.
-		w.Header().Add("Vary", "Origin")
+		// 排除的路径只能同源访问，不添加任何CORS响应头，预检请求也交给路由器处理
+		for _, prefix := range app.config.cors.excludedPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
 
-		// 针对预检请求添加响应头
-		w.Header().Add("Vary", "Access-Control-Request-Method")
+		// Add the "Vary: Origin" header，同时针对预检请求添加Access-Control-Request-Method
+		addVary(w.Header(), "Origin", "Access-Control-Request-Method")
 
 		// Get the value of the request's Origin header
 		origin := r.Header.Get("Origin")
@@ -232,11 +397,16 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						// 设置对于预检请求必要的响应头字段
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Prefer, Accept-Version")
 						// 	提前响应预检请求并返回 200 OK 状态码
 						w.WriteHeader(http.StatusOK)
 						return
 					}
+
+					// 对于实际的跨域请求，告诉浏览器哪些响应头可以被JS读取
+					if len(app.config.cors.exposeHeaders) > 0 {
+						w.Header().Set("Access-Control-Expose-Headers", strings.Join(app.config.cors.exposeHeaders, ", "))
+					}
 				}
 			}
 		}
@@ -246,12 +416,12 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 }
 
 func (app *application) metrics(next http.Handler) http.Handler {
-	// 当中间件链第一次构建时初始化新的expvar变量
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponseSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
+	// 当中间件链第一次构建时初始化新的expvar变量，再次构建时(例如测试中多次调用routes)复用已有的变量
+	totalRequestsReceived := publishedInt("total_requests_received")
+	totalResponseSent := publishedInt("total_responses_sent")
+	totalProcessingTimeMicroseconds := publishedInt("total_processing_time_μs")
 	// 声明一个新的map来保存每个响应状态码的数量
-	totalResponseSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+	totalResponseSentByStatus := publishedMap("total_responses_sent_by_status")
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
@@ -269,3 +439,18 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponseSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+// expvar不允许重复发布同名的变量，已经发布过时返回原来的变量
+func publishedInt(name string) *expvar.Int {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+	return expvar.NewInt(name)
+}
+
+func publishedMap(name string) *expvar.Map {
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/migrations"
+)
+
+// 一个迁移版本对应的up和down文件
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+// 读取嵌入的迁移文件，按版本号升序返回。文件名格式与migrate create -seq生成的一致：000001_name.up.sql
+func loadMigrations() ([]*migration, error) {
+	entries, err := fs.ReadDir(migrations.FS, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*migration)
+
+	for _, entry := range entries {
+		filename := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		prefix, name, found := strings.Cut(strings.TrimSuffix(filename, "."+direction+".sql"), "_")
+		if !found {
+			return nil, fmt.Errorf("invalid migration filename %q", filename)
+		}
+
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration filename %q", filename)
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+
+		if direction == "up" {
+			m.up = filename
+		} else {
+			m.down = filename
+		}
+	}
+
+	list := make([]*migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		list = append(list, m)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+
+	return list, nil
+}
+
+// 获取当前数据库的迁移版本，schema_migrations表的结构与golang-migrate保持一致，
+// 这样之前使用migrate工具迁移过的数据库也可以直接使用
+func currentMigrationVersion(db *sql.DB) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version bigint NOT NULL PRIMARY KEY,
+				dirty boolean NOT NULL
+			)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("database is dirty at migration version %d, fix it manually before migrating", version)
+	}
+
+	return version, nil
+}
+
+// 在一个事务中执行迁移文件并记录新的版本号，失败时整个迁移回滚
+func applyMigration(db *sql.DB, filename string, newVersion int64) error {
+	script, err := fs.ReadFile(migrations.FS, filename)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, string(script))
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if newVersion > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, newVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp 按顺序执行所有还没有执行过的up迁移
+func (app *application) migrateUp(db *sql.DB) error {
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := currentMigrationVersion(db)
+	if err != nil {
+		return err
+	}
+
+	applied := 0
+
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+
+		if m.up == "" {
+			return fmt.Errorf("missing up migration for version %d", m.version)
+		}
+
+		err = applyMigration(db, m.up, m.version)
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("applied migration", map[string]string{
+			"version": strconv.FormatInt(m.version, 10),
+			"name":    m.name,
+		})
+		applied++
+	}
+
+	if applied == 0 {
+		app.logger.PrintInfo("no pending migrations", map[string]string{
+			"version": strconv.FormatInt(current, 10),
+		})
+	}
+
+	return nil
+}
+
+// migrateDown 回滚最近一次执行的迁移，一次只回退一个版本
+func (app *application) migrateDown(db *sql.DB) error {
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := currentMigrationVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		app.logger.PrintInfo("no migrations to roll back", nil)
+		return nil
+	}
+
+	var previous int64
+
+	for i, m := range list {
+		if m.version != current {
+			continue
+		}
+
+		if m.down == "" {
+			return fmt.Errorf("missing down migration for version %d", m.version)
+		}
+
+		if i > 0 {
+			previous = list[i-1].version
+		}
+
+		err = applyMigration(db, m.down, previous)
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("rolled back migration", map[string]string{
+			"version": strconv.FormatInt(m.version, 10),
+			"name":    m.name,
+		})
+		return nil
+	}
+
+	return fmt.Errorf("no migration file found for current version %d", current)
+}
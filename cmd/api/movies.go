@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"github.com/LTXWorld/greenLight_copy/internal/data"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"time"
 )
 
 // 将传来的JSON请求转换为Go数据,并对JSON请求的格式以及其中具体数据进行校验是否出错
@@ -37,24 +40,27 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// 对输入进行检查（上面readJSON不是已经检查了一遍了吗？)
 	// readJSON中只是对JSON格式进行了检查，而这里是对每一个具体的属性进行检查,并给出对应的错误提示。
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, app.config.movieRules); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the Insert() passing in a pointer to the validated movie struct
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieCreated, movie)
+
 	// 发送HTTP响应，希望包含一个Location头部，让客户端知道可以在哪个URL找到新建资源
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("Location", app.locationURL(r, fmt.Sprintf("/v1/movies/%d", movie.ID)))
 
 	// Write a JSON response with a 201 Created status code
-	err = app.writeJSON(w, http.StatusCreated, envelop{"movie": movie}, headers)
+	err = app.writeJSONOrMinimal(w, r, http.StatusCreated, envelop{"movie": app.versionedMovie(r, movie)}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -68,8 +74,19 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// include中列出响应中需要附加的数据，目前只支持genre_stats
+	v := validator.New()
+	include := app.readCSV(r.URL.Query(), "include", []string{})
+	for _, value := range include {
+		v.Check(validator.In(value, "genre_stats"), "include", "must only contain genre_stats")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Get method to fetch the data for a specific movie
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -80,8 +97,30 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	env := envelop{"movie": app.versionedMovie(r, movie)}
+
+	// 各个类型的使用次数随其他movie的修改而变化，与这部movie的updated_at无关，所以附加了统计时不使用条件请求
+	if len(include) > 0 {
+		counts, err := app.models.Movies.GetGenreCounts(r.Context(), movie.Genres)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["genre_stats"] = counts
+	} else {
+		// HTTP日期只精确到秒，updated_at也是秒级精度
+		lastModified := movie.UpdatedAt.UTC().Truncate(time.Second)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+		// 客户端缓存的版本之后没有修改过，直接返回304，无法解析的日期忽略
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	// Encode，将数据先封装在一个map中，再写进JSON去传输
-	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -98,7 +137,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Fetch the existing movie record from the database
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.GetForUpdate(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -144,14 +183,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Validate the updated movie record
 	v := validator.New()
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, app.config.movieRules); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Pass the updated record to Databases
 	// Update use the version to prevent data race
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -162,8 +201,111 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieUpdated, movie)
+
 	// Write the uploaded movie record as a JSON response
-	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, nil)
+	err = app.writeJSONOrMinimal(w, r, http.StatusOK, envelop{"movie": app.versionedMovie(r, movie)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 使用请求体完整替换movie，与PATCH不同，所有字段都必须提供，没有提供的字段会作为零值参与校验
+func (app *application) replaceMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// 先读取现有的记录，替换时同样通过version检查并发的修改
+	movie, err := app.models.Movies.GetForUpdate(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie.Title = input.Title
+	movie.Year = input.Year
+	movie.Runtime = input.Runtime
+	movie.Genres = input.Genres
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie, app.config.movieRules); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Movies.Update(r.Context(), movie, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieUpdated, movie)
+
+	err = app.writeJSONOrMinimal(w, r, http.StatusOK, envelop{"movie": app.versionedMovie(r, movie)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 只对请求体执行与创建movie相同的校验，不写入数据库，方便前端在提交前检查输入
+func (app *application) validateMovieHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie := &data.Movie{
+		Title:   input.Title,
+		Year:    input.Year,
+		Runtime: input.Runtime,
+		Genres:  input.Genres,
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie, app.config.movieRules); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"valid": true}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -179,7 +321,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Delete the movie from the database
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -190,6 +332,9 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieDeleted, envelop{"id": id})
+
 	// Return a 200 ok status code
 	err = app.writeJSON(w, http.StatusOK, envelop{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -197,6 +342,79 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// 撤销movie的软删除，返回恢复后的movie
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrMovieNotDeleted):
+			app.movieNotDeletedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieRestored, movie)
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"movie": app.versionedMovie(r, movie)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 删除所有满足title和genres过滤条件的movie，必须带上confirm=true查询参数，防止误操作
+func (app *application) deleteMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readDelimited(qs, "genres", app.readString(qs, "genres_sep", ","), []string{})
+
+	if v.Check(app.readString(qs, "confirm", "") == "true", "confirm", "must be true to delete movies"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var deleted int64
+	var err error
+
+	// 与单个删除一样，每个被删除的movie发送一个事件，只有订阅了该事件才需要取回id
+	if app.eventSubscribed(webhook.EventMovieDeleted) {
+		var ids []int64
+		ids, err = app.models.Movies.DeleteAllIDs(r.Context(), title, genres)
+		for _, id := range ids {
+			app.publishEvent(webhook.EventMovieDeleted, envelop{"id": id})
+		}
+		deleted = int64(len(ids))
+	} else {
+		deleted, err = app.models.Movies.DeleteAll(r.Context(), title, genres)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if deleted > 0 {
+		app.invalidateListingCache()
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"deleted": deleted}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 // 列出请求体中指定类型，名称，页码等的各个符合条件的movies信息，存储在HTTP响应中
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -211,15 +429,11 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	// 会将black+panther转换为black panther
 	input.Title = app.readString(qs, "title", "") // 在 URL 查询参数中，+ 号通常会被解释为空格
-	input.Genres = app.readCSV(qs, "genres", []string{})
-
-	//
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// genres默认以逗号分隔，类型本身包含逗号时可以用genres_sep指定其他分隔符，例如genres=a|b&genres_sep=|
+	input.Genres = app.readDelimited(qs, "genres", app.readString(qs, "genres_sep", ","), []string{})
 
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	// Add the supported sort values for this endpoint to the sort safelist
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// 默认值和允许的排序字段来自data.MovieSortSafelist，与GraphQL和gRPC的列表接口一致
+	input.Filters = app.readFilters(qs, "id", data.MovieSortSafelist, v)
 
 	// ValidateFilters中有一堆check,Valid会检查这些check的结果是否最终有错误发生
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -227,14 +441,288 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// 太深的分页让数据库扫描大量最终被丢弃的行
+	offset := input.Filters.Offset()
+	if app.config.moviesMaxOffset > 0 && offset > app.config.moviesMaxOffset {
+		app.badRequestResponse(w, r, fmt.Errorf("page is too deep (offset %d exceeds %d): narrow the title or genres filters", offset, app.config.moviesMaxOffset))
+		return
+	}
+
+	// 启用了列表缓存时先尝试从缓存中读取
+	env, gen, found := app.cachedListing(r)
+	if found {
+		err := app.writeJSONStream(w, http.StatusOK, env, nil)
+		if err != nil {
+			app.logError(r, err)
+		}
+		return
+	}
+
+	// 结果会写入列表缓存时从主库读取，副本上落后的数据不能在缓存中一直保留到下一次失效
+	ctx := r.Context()
+	if app.listingCache != nil {
+		ctx = data.WithPrimary(ctx)
+	}
+
 	// Call the GetAll() method to retrieve the movies, passing in the various filter parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(ctx, input.Title, input.Genres, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env = envelop{"movies": app.versionedMovies(r, movies), "metadata": metadata}
+	app.cacheListing(r, gen, env)
+
+	// 列表可能很大，直接流式写出。此时响应头已经发送，出错时只能记录日志
+	err = app.writeJSONStream(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// 增量同步：返回since之后创建或更新的movie以及被删除的movie的id。
+// 响应中的since是新的高水位标记，has_more为true时客户端应该立即用它继续请求下一批
+func (app *application) listMovieChangesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	since := app.readInt(qs, "since", 0, v)
+	limit := app.readInt(qs, "limit", 100, v)
+
+	v.Check(since >= 0, "since", "must not be negative")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 1000, "limit", "must be a maximum of 1000")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, deleted, highWater, err := app.models.Movies.GetChanges(r.Context(), int64(since), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{
+		"movies":   app.versionedMovies(r, movies),
+		"deleted":  deleted,
+		"since":    highWater,
+		"has_more": len(movies)+len(deleted) == limit,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 返回与指定movie类型相近的movie列表
+func (app *application) listSimilarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 100, "limit", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// 先确认目标movie存在，不存在时返回404而不是空列表
+	_, err = app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movies, err := app.models.Movies.GetSimilar(r.Context(), id, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"movies": app.versionedMovies(r, movies)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 向movie的genres中添加一个类型，已经存在时直接返回当前列表
+func (app *application) addMovieGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Genre string `json:"genre"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie, err := app.models.Movies.GetForUpdate(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Genre != "", "genre", "must be provided")
+	v.Check(len(input.Genre) <= app.config.movieRules.MaxGenreLength, "genre", fmt.Sprintf("must not be more than %d bytes long", app.config.movieRules.MaxGenreLength))
+	v.Check(len(data.InvalidGenres([]string{input.Genre}, app.config.movieRules.AllowedGenres)) == 0, "genre", "is not an allowed genre")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !validator.In(input.Genre, movie.Genres...) {
+		// 与ValidateMovie中的数量限制保持一致
+		maxGenres := app.config.movieRules.MaxGenres
+		if v.Check(len(movie.Genres) < maxGenres, "genres", "must not contain more than "+data.PluralGenres(maxGenres)); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.models.Movies.AddGenre(r.Context(), movie, input.Genre, app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.invalidateListingCache()
+		app.publishEvent(webhook.EventMovieUpdated, movie)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"genres": movie.Genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 从movie的genres中删除一个类型，movie至少需要保留一个类型
+func (app *application) removeMovieGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre := httprouter.ParamsFromContext(r.Context()).ByName("genre")
+
+	movie, err := app.models.Movies.GetForUpdate(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !validator.In(genre, movie.Genres...) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	minGenres := app.config.movieRules.MinGenres
+	if v.Check(len(movie.Genres) > minGenres, "genres", "must contain at least "+data.PluralGenres(minGenres)); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Movies.RemoveGenre(r.Context(), movie, genre, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateListingCache()
+	app.publishEvent(webhook.EventMovieUpdated, movie)
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"genres": movie.Genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 分页返回movie的修改历史，最新的版本在前
+func (app *application) listMovieVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := app.readFilters(qs, "-version", data.MovieVersionSortSafelist, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	versions, metadata, err := app.models.Movies.GetVersions(r.Context(), id, filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelop{"versions": versions, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+)
+
+func TestShowMovieHandlerConditionalGet(t *testing.T) {
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	app := newTestApplication(t)
+	app.models.Movies.(*mockMovieModel).movies[1] = &data.Movie{
+		ID:        1,
+		UpdatedAt: updatedAt,
+		Title:     "Moana",
+		Year:      2016,
+		Genres:    []string{"animation"},
+		Version:   1,
+	}
+	token := addTestUser(app, "movies:read")
+
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name            string
+		urlPath         string
+		ifModifiedSince string
+		status          int
+		body            string
+	}{
+		{name: "no condition", urlPath: "/v1/movies/1", status: http.StatusOK, body: `"title":"Moana"`},
+		{name: "not modified", urlPath: "/v1/movies/1", ifModifiedSince: updatedAt.Format(http.TimeFormat), status: http.StatusNotModified},
+		{name: "modified since", urlPath: "/v1/movies/1", ifModifiedSince: updatedAt.Add(-time.Hour).Format(http.TimeFormat), status: http.StatusOK, body: `"title":"Moana"`},
+		{name: "not found", urlPath: "/v1/movies/2", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := authHeader(token)
+			if tt.ifModifiedSince != "" {
+				headers.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+
+			status, header, body := ts.get(t, tt.urlPath, headers)
+
+			if status != tt.status {
+				t.Errorf("got status %d; want %d", status, tt.status)
+			}
+			if tt.status != http.StatusNotFound && header.Get("Last-Modified") != updatedAt.Format(http.TimeFormat) {
+				t.Errorf("got Last-Modified %q; want %q", header.Get("Last-Modified"), updatedAt.Format(http.TimeFormat))
+			}
+			if !strings.Contains(body, tt.body) {
+				t.Errorf("body %q does not contain %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestShowMovieHandlerRequiresPermission(t *testing.T) {
+	app := newTestApplication(t)
+	token := addTestUser(app)
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, _ := ts.get(t, "/v1/movies/1", authHeader(token))
+	if status != http.StatusForbidden {
+		t.Errorf("got status %d; want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestListMoviesHandlerRejectsDeepOffset(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.moviesMaxOffset = 10_000
+	token := addTestUser(app, "movies:read")
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.get(t, "/v1/movies?page=102&page_size=100", authHeader(token))
+	if status != http.StatusBadRequest {
+		t.Fatalf("got status %d; want %d", status, http.StatusBadRequest)
+	}
+	if !strings.Contains(body, "page is too deep") {
+		t.Errorf("got body %q; want it to explain the offset limit", body)
+	}
+}
+
+func TestShowMovieHandlerIncludeGenreStats(t *testing.T) {
+	app := newTestApplication(t)
+	movies := app.models.Movies.(*mockMovieModel).movies
+	movies[1] = &data.Movie{ID: 1, Title: "Moana", Genres: []string{"animation", "adventure"}, Version: 1}
+	movies[2] = &data.Movie{ID: 2, Title: "Up", Genres: []string{"animation"}, Version: 1}
+	token := addTestUser(app, "movies:read")
+
+	ts := newTestServer(t, app.routes())
+
+	_, header, body := ts.get(t, "/v1/movies/1?include=genre_stats", authHeader(token))
+	if !strings.Contains(body, `"genre_stats":{"adventure":1,"animation":2}`) {
+		t.Errorf("body %q does not contain the expected genre_stats", body)
+	}
+	if header.Get("Last-Modified") != "" {
+		t.Errorf("got Last-Modified %q with genre_stats; want none", header.Get("Last-Modified"))
+	}
+
+	_, _, body = ts.get(t, "/v1/movies/1", authHeader(token))
+	if strings.Contains(body, "genre_stats") {
+		t.Errorf("body %q contains genre_stats without include", body)
+	}
+
+	status, _, _ := ts.get(t, "/v1/movies/1?include=cast", authHeader(token))
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an unknown include; want %d", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestRestoreMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	mock := app.models.Movies.(*mockMovieModel)
+	mock.movies[1] = &data.Movie{ID: 1, Title: "Moana", Genres: []string{"animation"}, Version: 1}
+	mock.deleted[2] = &data.Movie{ID: 2, Title: "Up", Genres: []string{"animation"}, Version: 1}
+	token := addTestUser(app, "movies:write")
+
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   string
+	}{
+		{name: "deleted", path: "/v1/movies/2/restore", status: http.StatusOK, want: `"title":"Up"`},
+		{name: "not deleted", path: "/v1/movies/1/restore", status: http.StatusUnprocessableEntity, want: errCodeNotDeleted},
+		{name: "missing", path: "/v1/movies/3/restore", status: http.StatusNotFound, want: errCodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := ts.post(t, tt.path, authHeader(token), "")
+			if status != tt.status {
+				t.Fatalf("got status %d; want %d", status, tt.status)
+			}
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("body %q does not contain %q", body, tt.want)
+			}
+		})
+	}
+
+	// 恢复之后可以再次读取
+	if _, ok := mock.movies[2]; !ok {
+		t.Error("restored movie is not visible")
+	}
+}
+
+// 只有movies:write的用户可以修改和恢复但是不能删除
+func TestDeleteMovieRequiresDeletePermission(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies.(*mockMovieModel).deleted[1] = &data.Movie{ID: 1, Title: "Moana", Genres: []string{"animation"}, Version: 1}
+	token := addTestUser(app, "movies:read", "movies:write")
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, _ := ts.do(t, http.MethodDelete, "/v1/movies/1", authHeader(token), "")
+	if status != http.StatusForbidden {
+		t.Errorf("delete: got status %d; want %d", status, http.StatusForbidden)
+	}
+
+	status, _, _ = ts.post(t, "/v1/movies/1/restore", authHeader(token), "")
+	if status != http.StatusOK {
+		t.Errorf("restore: got status %d; want %d", status, http.StatusOK)
+	}
+}
+
+// 批量删除同时需要movies:delete和movies:admin，权限列表只读取一次
+func TestDeleteMoviesRequiresAllPermissions(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies.(*mockMovieModel).movies[1] = &data.Movie{ID: 1, Title: "Moana"}
+	permissions := app.models.Permissions.(*mockPermissionModel)
+	deleteOnly := addTestUser(app, "movies:delete")
+	admin := addTestUser(app, "movies:delete", "movies:admin")
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, _ := ts.do(t, http.MethodDelete, "/v1/movies?confirm=true", authHeader(deleteOnly), "")
+	if status != http.StatusForbidden {
+		t.Errorf("movies:delete only: got status %d; want %d", status, http.StatusForbidden)
+	}
+
+	permissions.loads = 0
+	status, _, body := ts.do(t, http.MethodDelete, "/v1/movies?confirm=true", authHeader(admin), "")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"deleted":1`) {
+		t.Errorf("got body %q; want 1 deleted movie", body)
+	}
+	if permissions.loads != 1 {
+		t.Errorf("permissions loaded %d times; want 1", permissions.loads)
+	}
+}
+
+func TestDeleteMoviesHandlerPublishesEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		events = append(events, r.Header.Get("X-Greenlight-Event")+" "+string(body))
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	app := newTestApplication(t)
+	app.webhooks = webhook.New([]string{receiver.URL}, []string{webhook.EventMovieDeleted}, "")
+	for id := int64(1); id <= 2; id++ {
+		app.models.Movies.(*mockMovieModel).movies[id] = &data.Movie{ID: id, Title: "Moana"}
+	}
+	token := addTestUser(app, "movies:delete", "movies:admin")
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.do(t, http.MethodDelete, "/v1/movies?confirm=true", authHeader(token), "")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"deleted":2`) {
+		t.Errorf("got body %q; want 2 deleted movies", body)
+	}
+
+	app.wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("got %d webhook events; want 2: %v", len(events), events)
+	}
+	for _, id := range []string{`"id":1`, `"id":2`} {
+		found := false
+		for _, event := range events {
+			if strings.HasPrefix(event, webhook.EventMovieDeleted) && strings.Contains(event, id) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no %s event for %s: %v", webhook.EventMovieDeleted, id, events)
+		}
+	}
+}
+
+func TestImportMoviesHandlerLimits(t *testing.T) {
+	line := `{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}` + "\n"
+
+	t.Run("insert failure reports imported", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.config.importMaxLines = 10
+		app.config.importMaxBytes = 1 << 20
+		app.models.Movies.(*mockMovieModel).insertLimit = 2
+		token := addTestUser(app, "movies:write")
+
+		ts := newTestServer(t, app.routes())
+
+		status, _, body := ts.post(t, "/v1/movie-imports", authHeader(token), strings.Repeat(line, 3))
+		if status != http.StatusInternalServerError {
+			t.Fatalf("got status %d; want %d: %s", status, http.StatusInternalServerError, body)
+		}
+		if !strings.Contains(body, `"imported":2`) {
+			t.Errorf("got body %q; want it to report 2 imported movies", body)
+		}
+	})
+
+	t.Run("total body size", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.config.importMaxLines = 10
+		app.config.importMaxBytes = int64(len(line) * 2)
+		token := addTestUser(app, "movies:write")
+
+		ts := newTestServer(t, app.routes())
+
+		status, _, body := ts.post(t, "/v1/movie-imports", authHeader(token), strings.Repeat(line, 3))
+		if status != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", status, http.StatusOK, body)
+		}
+		if !strings.Contains(body, `"imported":2`) || !strings.Contains(body, "must not be larger than") {
+			t.Errorf("got body %q; want 2 imported movies and a body size error", body)
+		}
+	})
+}
@@ -17,23 +17,88 @@ func (app *application) routes() http.Handler {
 	// 注册路由,方法+路由+处理器
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
-	// 将关于/v1/movies**的路由全部封装在requirePermission()中间件中，其下封装了requireActivatedUser和requireAuthenticatedUser
+	// 将关于/v1/movies**的路由全部封装在requirePermission()中间件中，其下封装了requireActivatedUser和requireAuthenticatedUser。
+	// httprouter中同一个方法下/v1/movies/后面不能同时出现固定的路径和:id，所以路径统一按以下方式安排：
+	// 针对单部movie的操作放在/v1/movies/:id/下面，针对整个集合的操作(导入，校验，增量同步)使用单独的/v1/movie-*路径
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.validateSchema("movie_create", app.createMovieHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission("movies:read", app.listGenresHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movie-changes", app.requirePermission("movies:read", app.listMovieChangesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movie-imports", app.requirePermission("movies:write", app.importMoviesHandler))
+	// 只校验不创建，和创建时使用相同的schema
+	router.HandlerFunc(http.MethodPost, "/v1/movie-validations", app.requirePermission("movies:write", app.validateSchema("movie_create", app.validateMovieHandler)))
+	// 删除需要单独的movies:delete权限，批量删除额外要求movies:admin权限
+	router.HandlerFunc(http.MethodDelete, "/v1/movies", app.requirePermissions(app.deleteMoviesHandler, "movies:delete", "movies:admin"))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.requirePermission("movies:read", app.listSimilarMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/versions", app.requirePermission("movies:read", app.listMovieVersionsHandler))
+	// PATCH只更新请求体中出现的字段，PUT用请求体完整替换整条记录，所以使用与创建相同的schema
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.validateSchema("movie_update", app.updateMovieHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id", app.requirePermission("movies:write", app.validateSchema("movie_create", app.replaceMovieHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:delete", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission("movies:write", app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/genres", app.requirePermission("movies:write", app.addMovieGenreHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/genres/:genre", app.requirePermission("movies:write", app.removeMovieGenreHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users", app.requirePermission("users:read", app.listUsersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.validateSchema("user_register", app.registerUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.validateSchema("user_activate", app.activateUserHandler))
+	// 修改账户资料要求最近验证过邮件，过期时通过POST /v1/tokens/verification重新验证
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireRecentVerification(app.config.verificationMaxAge, app.updateCurrentUserHandler))
+	// 没有激活的用户同样可以导出自己的数据
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticatedUser(app.exportCurrentUserHandler))
+	// 与movie相同，针对单个用户的操作放在/v1/users/:id/下面。PATCH /v1/users/:id/activate会与PATCH /v1/users/me冲突，
+	// 所以管理员手动激活用户使用POST
+	router.HandlerFunc(http.MethodPost, "/v1/users/:id/activate", app.requirePermission("users:write", app.forceActivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.validateSchema("token_activation", app.createActivationTokenHandler))
+	// 验证过期之后(requireRecentVerification返回403)重新验证邮件地址
+	router.HandlerFunc(http.MethodPut, "/v1/users/verified", app.validateSchema("user_verify", app.verifyUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/verification", app.requireActivatedUser(app.createVerificationTokenHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.validateSchema("token_authentication", app.createAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.listAuthenticationTokensHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/stats", app.requirePermission("stats:read", app.showStatsHandler))
+
+	// 查看发件队列，默认列出发送失败的邮件
+	router.HandlerFunc(http.MethodGet, "/v1/emails", app.requirePermission("emails:read", app.listEmailsHandler))
+
+	// GraphQL只提供读查询，认证和权限检查在各个解析器中进行
+	router.HandlerFunc(http.MethodPost, "/v1/graphql", app.graphqlHandler)
+
+	// WebSocket推送movie事件，令牌放在Sec-WebSocket-Protocol中，权限在升级之前检查
+	router.HandlerFunc(http.MethodGet, "/v1/ws", app.requirePermission("movies:read", app.websocketHandler))
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
+	// 请求体在路由内部才被读取，记录请求体的中间件紧贴着router
+	handler := app.logFailedRequestBodies(app.negotiateVersion(router))
+
+	// 默认先限流再认证，带着无效令牌的请求同样被限流，不会无限制地查询数据库。
+	// 开启-limiter-exempt时需要知道用户是谁，改为先认证再限流；认证失败的请求到不了rateLimit，
+	// 由authenticateLimited使用同样的速率按IP限流
+	if app.config.limiter.exempt {
+		failures := newIPLimiter(app.config.limiter.rps, app.config.limiter.burst)
+		handler = app.authenticateLimited(failures, app.rateLimit(handler))
+	} else {
+		handler = app.rateLimit(app.authenticate(handler))
+	}
+
 	// Return the httprouter instance
 	// Wrap the router with the panic recovery middleware
-	// 将性能分析封装在最外层——总请求数，总响应数，总处理时间
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// 并发限制放在enableCORS里面：503响应同样带有CORS头，预检请求不占用名额
+	handler = app.recoverPanic(app.securityHeaders(app.enableCORS(app.limitInFlight(handler))))
+
+	// span覆盖除了metrics之外的整个中间件链，认证和权限查询也会作为子span出现
+	if app.config.otelEndpoint != "" {
+		handler = app.tracing(handler)
+	}
+
+	// 将性能分析封装在最外层——总请求数，总响应数，总处理时间。
+	// 放在enableCORS外面，这样在enableCORS中提前返回的预检请求也和其他请求一样被计入请求数和响应数
+	if app.config.metricsEnabled {
+		handler = app.metrics(handler)
+	}
+
+	return handler
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/LTXWorld/greenLight_copy/internal/jsonschema"
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// 请求体的schema文件，文件名（去掉.json）就是在routes中使用的名字
+//
+//go:embed schemas/*.json
+var schemaFS embed.FS
+
+// 读取并编译所有嵌入的schema文件
+func loadSchemas() (map[string]*jsonschema.Schema, error) {
+	entries, err := fs.ReadDir(schemaFS, "schemas")
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]*jsonschema.Schema)
+
+	for _, entry := range entries {
+		doc, err := fs.ReadFile(schemaFS, "schemas/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		schema, err := jsonschema.Compile(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		schemas[strings.TrimSuffix(entry.Name(), ".json")] = schema
+	}
+
+	return schemas, nil
+}
+
+// validateSchema 在处理器读取请求体之前用指定的schema检查原始请求体，不满足时返回422。
+// 没有启用schema校验时直接调用下一个处理器；请求体不是合法JSON时也直接放行，由readJSON返回原有的400错误
+func (app *application) validateSchema(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema, ok := app.schemas[name]
+		// Content-Length超过限制的请求体不读取，交给readJSON返回与其他接口一致的错误
+		if !ok || r.ContentLength > 1_048_576 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 与readJSON使用相同的大小限制，读完之后再把请求体放回去
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		v := validator.New()
+
+		err = schema.Validate(v, body)
+		if err == nil && !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+)
+
+// 开发环境中使用的测试账户，密码是已知的方便本地调试
+var seedUsers = []struct {
+	name        string
+	email       string
+	password    string
+	permissions []string
+}{
+	{name: "Admin User", email: "admin@example.com", password: "pa55word1234", permissions: []string{"movies:read", "movies:write", "movies:delete"}},
+	{name: "Reader User", email: "reader@example.com", password: "pa55word1234", permissions: []string{"movies:read"}},
+}
+
+// 随机生成电影标题和类型时使用的词库
+var (
+	seedTitleAdjectives = []string{"Silent", "Crimson", "Lost", "Electric", "Broken", "Golden", "Hidden", "Last", "Midnight", "Wild"}
+	seedTitleNouns      = []string{"River", "Empire", "Horizon", "Garden", "Signal", "Kingdom", "Voyage", "Shadow", "Harbor", "Machine"}
+	seedGenres          = []string{"action", "adventure", "animation", "comedy", "crime", "drama", "fantasy", "horror", "romance", "sci-fi", "thriller", "western"}
+)
+
+// seed 向开发数据库中写入测试用户和随机电影，所有数据都通过已有的model方法插入。
+// 权限表中的权限由迁移文件以及启动时的EnsureCodes创建，这里只为测试用户分配权限
+func (app *application) seed(movieCount int) error {
+	if app.config.env == "production" {
+		return errors.New("refusing to seed the database when env=production")
+	}
+
+	ctx := context.Background()
+
+	for _, su := range seedUsers {
+		user := &data.User{
+			Name:      su.name,
+			Email:     su.email,
+			Activated: true,
+		}
+
+		err := user.Password.Set(su.password)
+		if err != nil {
+			return err
+		}
+
+		err = app.models.Users.Insert(ctx, user)
+		if err != nil {
+			switch {
+			// 多次执行seed时跳过已经存在的用户
+			case errors.Is(err, data.ErrDuplicateEmail):
+				app.logger.PrintInfo("seed user already exists", map[string]string{"email": su.email})
+				continue
+			default:
+				return err
+			}
+		}
+
+		// Insert不会写入verified_at，这里补上验证时间，使其能够通过requireRecentVerification
+		now := time.Now()
+		user.VerifiedAt = &now
+
+		err = app.models.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		err = app.models.Permissions.AddForUser(ctx, user.ID, su.permissions...)
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("seeded user", map[string]string{
+			"email":    su.email,
+			"password": su.password,
+		})
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for i := 0; i < movieCount; i++ {
+		movie := &data.Movie{
+			Title:   fmt.Sprintf("The %s %s", seedTitleAdjectives[rng.Intn(len(seedTitleAdjectives))], seedTitleNouns[rng.Intn(len(seedTitleNouns))]),
+			Year:    int32(1900 + rng.Intn(time.Now().Year()-1900+1)),
+			Runtime: data.Runtime((60 + rng.Intn(121)) * 60),
+			Genres:  randomGenres(rng),
+		}
+
+		err := app.models.Movies.Insert(ctx, movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.logger.PrintInfo("seeded movies", map[string]string{
+		"count": strconv.Itoa(movieCount),
+	})
+
+	return nil
+}
+
+// 随机挑选1到3个不重复的电影类型
+func randomGenres(rng *rand.Rand) []string {
+	n := 1 + rng.Intn(3)
+	genres := make([]string, 0, n)
+
+	for _, i := range rng.Perm(len(seedGenres))[:n] {
+		genres = append(genres, seedGenres[i])
+	}
+
+	return genres
+}
@@ -2,21 +2,226 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/proxyproto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
+// 拼接监听地址，使用JoinHostPort以便正确处理IPv6地址
+func listenAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// 检查-host和端口的组合，host只能是IP地址或者主机名，不能带端口
+func validateListenAddr(cfg config) error {
+	if cfg.port < 1 || cfg.port > 65535 {
+		return fmt.Errorf("invalid -port %d (must be between 1 and 65535)", cfg.port)
+	}
+	if cfg.grpc.port < 0 || cfg.grpc.port > 65535 {
+		return fmt.Errorf("invalid -grpc-port %d (must be between 0 and 65535)", cfg.grpc.port)
+	}
+	if cfg.socket == "" && cfg.grpc.port == cfg.port {
+		return fmt.Errorf("-grpc-port must differ from -port (both are %d)", cfg.port)
+	}
+
+	if cfg.socket != "" && cfg.host != "" {
+		return errors.New("-host cannot be used together with -socket")
+	}
+
+	if cfg.tls.redirect {
+		switch {
+		case cfg.tls.certFile == "":
+			return errors.New("-tls-redirect requires -tls-cert and -tls-key")
+		case cfg.socket != "":
+			return errors.New("-tls-redirect cannot be used together with -socket")
+		case cfg.tls.redirectPort < 1 || cfg.tls.redirectPort > 65535:
+			return fmt.Errorf("invalid -tls-redirect-port %d (must be between 1 and 65535)", cfg.tls.redirectPort)
+		case cfg.tls.redirectPort == cfg.port || cfg.tls.redirectPort == cfg.grpc.port:
+			return fmt.Errorf("-tls-redirect-port must differ from -port and -grpc-port (got %d)", cfg.tls.redirectPort)
+		}
+	}
+
+	if cfg.host == "" || net.ParseIP(cfg.host) != nil {
+		return nil
+	}
+	if strings.ContainsAny(cfg.host, ":/[] ") {
+		return fmt.Errorf("invalid -host %q (must be an IP address or hostname without a port)", cfg.host)
+	}
+
+	return nil
+}
+
+// socket文件的权限，同一用户组中的反向代理可以连接
+const socketFileMode = 0660
+
+// listen 创建HTTP服务器的监听器，设置了-socket时监听Unix socket，否则监听TCP地址
+func (app *application) listen(addr string) (net.Listener, error) {
+	if app.config.socket == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	// 上次没有正常退出时socket文件会留下来，导致Listen返回address already in use。
+	// 只删除socket文件，路径上是其他类型的文件时返回错误，避免误删
+	info, err := os.Lstat(app.config.socket)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("-socket path %q exists and is not a socket", app.config.socket)
+	case err == nil:
+		err = os.Remove(app.config.socket)
+		if err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	// net.Listen创建的UnixListener在Close时会删除socket文件，Shutdown之后不会留下文件
+	ln, err := net.Listen("unix", app.config.socket)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(app.config.socket, socketFileMode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// 将明文HTTP请求永久重定向到HTTPS地址，主机名不变，端口换成-port
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	// SplitHostPort会去掉IPv6地址的方括号，没有端口的IPv6地址仍然带着方括号
+	host = strings.Trim(host, "[]")
+
+	if app.config.port != 443 {
+		host = listenAddr(host, app.config.port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+
+	// 301之后客户端可能把POST等请求改成GET，明文入口只是给浏览器用的，API客户端应该直接使用HTTPS
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// 启动-tls-redirect的明文HTTP服务器，与gRPC服务器一样在主服务器之前创建监听器，关闭时一起Shutdown
+func (app *application) serveTLSRedirect() (*http.Server, error) {
+	srv := &http.Server{
+		Addr:         listenAddr(app.config.host, app.config.tls.redirectPort),
+		Handler:      http.HandlerFunc(app.redirectToHTTPS),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		ErrorLog:     log.New(app.logger, "", 0),
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfo("starting TLS redirect server", map[string]string{
+		"addr": ln.Addr().String(),
+	})
+
+	go func() {
+		err := srv.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, nil)
+		}
+	}()
+
+	return srv, nil
+}
+
+// 记录正在处理的h2c请求。h2c连接是被劫持的连接，http.Server的Shutdown不会等待其中的请求
+type h2cTracker struct {
+	active atomic.Int64
+}
+
+func (t *h2cTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 经过h2c.NewHandler的请求中只有h2c请求是HTTP/2
+		if r.ProtoMajor == 2 {
+			t.active.Add(1)
+			defer t.active.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 与Shutdown一样轮询，直到没有正在处理的h2c请求或者ctx结束
+func (t *h2cTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for t.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// configureHTTP2 按-http2设置服务器。明文监听时返回记录h2c请求的h2cTracker，关闭服务器时用来等待这些请求结束
+func (app *application) configureHTTP2(srv *http.Server) (*h2cTracker, error) {
+	if !app.config.http2 {
+		// TLSNextProto为nil时ServeTLS会自动启用h2，设置为非nil的空map才能只使用HTTP/1.1
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil, nil
+	}
+
+	h2s := &http2.Server{IdleTimeout: time.Minute}
+
+	// 注册h2的TLS协商(ALPN)以及关闭服务器时向HTTP/2连接发送GOAWAY
+	err := http2.ConfigureServer(srv, h2s)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.config.tls.certFile != "" {
+		return nil, nil
+	}
+
+	// 明文监听时使用h2c处理"prior knowledge"和Upgrade: h2c的请求。
+	// 大多数反向代理不会向后端发送h2c，放在代理后面时一般仍然是HTTP/1.1
+	tracker := &h2cTracker{}
+	srv.Handler = h2c.NewHandler(tracker.track(srv.Handler), h2s)
+
+	return tracker, nil
+}
+
 func (app *application) serve() error {
 	// Declare a HTTP server using the same settings in our main() function
 	// 声明一个HTTP服务器保存地址，处理器，时间戳等信息，并使用mux
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Addr:         listenAddr(app.config.host, app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
@@ -26,6 +231,52 @@ func (app *application) serve() error {
 		ErrorLog: log.New(app.logger, "", 0),
 	}
 
+	// 使用Unix socket时Addr只用于日志
+	if app.config.socket != "" {
+		srv.Addr = "unix:" + app.config.socket
+	}
+
+	// 只使用TLS 1.2及以上的版本，并优先使用性能更好的椭圆曲线
+	if app.config.tls.certFile != "" {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:       tls.VersionTLS12,
+			CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		}
+	}
+
+	h2cRequests, err := app.configureHTTP2(srv)
+	if err != nil {
+		return err
+	}
+
+	// 在启动gRPC服务器之前创建监听器，地址被占用等错误可以直接返回
+	ln, err := app.listen(listenAddr(app.config.host, app.config.port))
+	if err != nil {
+		return err
+	}
+
+	// PROXY头在TLS握手之前，所以要包在TLS之下；没有PROXY头的连接会被关闭
+	if app.config.proxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, HeaderTimeout: srv.ReadTimeout}
+	}
+
+	// 配置了gRPC端口时，与HTTP服务器一起启动gRPC服务器
+	var grpcSrv *grpc.Server
+	if app.config.grpc.port > 0 {
+		grpcSrv, err = app.serveGRPC()
+		if err != nil {
+			return err
+		}
+	}
+
+	var redirectSrv *http.Server
+	if app.config.tls.redirect {
+		redirectSrv, err = app.serveTLSRedirect()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Create a shutdownError channel. Use this shutdownError receive any errors returned
 	// by the graceful Shutdown() function
 	shutdownError := make(chan error)
@@ -57,14 +308,43 @@ func (app *application) serve() error {
 		if err != nil {
 			shutdownError <- err
 		}
+
+		// Shutdown会向h2c连接发送GOAWAY，但不会等待其中正在处理的请求，在同一个期限内单独等待
+		if h2cRequests != nil {
+			err := h2cRequests.wait(ctx)
+			if err != nil {
+				app.logger.PrintError(errors.New("h2c requests did not finish before the shutdown deadline"), map[string]string{
+					"running": strconv.FormatInt(h2cRequests.active.Load(), 10),
+				})
+			}
+		}
+
+		// 在同一个期限内关闭gRPC服务器，等待正在处理的调用结束
+		if grpcSrv != nil {
+			app.shutdownGRPC(ctx, grpcSrv)
+		}
+		if redirectSrv != nil {
+			err := redirectSrv.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
 		//
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
 
-		// Call Wait() to block until our WaitGroup counter is zero,then we return nil on
-		// the shutdownError channel, to indicate that the shutdown completed without any issues
-		app.wg.Wait()
+		// 通知长期运行的后台goroutine退出，然后再等待WaitGroup
+		close(app.shutdown)
+
+		// 在关闭期限内等待WaitGroup计数归零，超时后记录仍在运行的任务数并继续退出，
+		// 避免卡住的后台任务(例如正在重试的邮件)使服务器无法关闭
+		running := app.waitBackground(ctx)
+		if running > 0 {
+			app.logger.PrintError(errors.New("background tasks did not finish before the shutdown deadline"), map[string]string{
+				"running": strconv.FormatInt(running, 10),
+			})
+		}
 		shutdownError <- nil
 	}()
 
@@ -72,12 +352,17 @@ func (app *application) serve() error {
 	app.logger.PrintInfo("starting server ", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  strconv.FormatBool(app.config.tls.certFile != ""),
 	})
 
 	// Calling Shutdown() on our server will cause ListenAndServe() to immediately return
 	// a http.ErrServerClosed error. So if we see this,it is actually a good thing
 	// So we check specifically for this
-	err := srv.ListenAndServe()
+	if app.config.tls.certFile != "" {
+		err = srv.ServeTLS(ln, app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
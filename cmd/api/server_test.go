@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestValidateListenAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    int
+		wantErr bool
+		addr    string
+	}{
+		{name: "all interfaces", host: "", port: 4000, addr: ":4000"},
+		{name: "loopback", host: "127.0.0.1", port: 4000, addr: "127.0.0.1:4000"},
+		{name: "ipv6", host: "::1", port: 4000, addr: "[::1]:4000"},
+		{name: "hostname", host: "localhost", port: 4000, addr: "localhost:4000"},
+		{name: "host with port", host: "127.0.0.1:4000", port: 4000, wantErr: true},
+		{name: "port out of range", host: "", port: 70000, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.host = tt.host
+			cfg.port = tt.port
+
+			err := validateListenAddr(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && listenAddr(cfg.host, cfg.port) != tt.addr {
+				t.Errorf("got addr %q; want %q", listenAddr(cfg.host, cfg.port), tt.addr)
+			}
+		})
+	}
+}
+
+// 遗留的socket文件会被删除后重新监听，其他类型的文件不会被删除
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	app := &application{}
+	app.config.socket = filepath.Join(dir, "api.sock")
+
+	ln, err := app.listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟进程没有正常退出，socket文件仍然存在
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = app.listen("")
+	if err != nil {
+		t.Fatalf("listen on stale socket: %v", err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(app.config.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != socketFileMode {
+		t.Errorf("got socket mode %o; want %o", info.Mode().Perm(), socketFileMode)
+	}
+
+	app.config.socket = filepath.Join(dir, "regular")
+	err = os.WriteFile(app.config.socket, []byte("keep"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.listen("")
+	if err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if _, err := os.Stat(app.config.socket); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
+
+func TestValidateTLSRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		certFile     string
+		socket       string
+		redirectPort int
+		wantErr      bool
+	}{
+		{name: "valid", certFile: "cert.pem", redirectPort: 80},
+		{name: "without tls", redirectPort: 80, wantErr: true},
+		{name: "with socket", certFile: "cert.pem", socket: "/tmp/api.sock", redirectPort: 80, wantErr: true},
+		{name: "same port", certFile: "cert.pem", redirectPort: 4000, wantErr: true},
+		{name: "port out of range", certFile: "cert.pem", redirectPort: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.port = 4000
+			cfg.socket = tt.socket
+			cfg.tls.certFile = tt.certFile
+			cfg.tls.redirect = true
+			cfg.tls.redirectPort = tt.redirectPort
+
+			err := validateListenAddr(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		target string
+		host   string
+		want   string
+	}{
+		{name: "default port", port: 443, target: "/v1/movies?page=2", host: "api.example.com", want: "https://api.example.com/v1/movies?page=2"},
+		{name: "host with port", port: 443, target: "/v1/healthcheck", host: "api.example.com:80", want: "https://api.example.com/v1/healthcheck"},
+		{name: "custom port", port: 4000, target: "/v1/healthcheck", host: "api.example.com:8080", want: "https://api.example.com:4000/v1/healthcheck"},
+		{name: "ipv6", port: 443, target: "/", host: "[::1]:80", want: "https://[::1]/"},
+		{name: "ipv6 custom port", port: 4000, target: "/", host: "[::1]", want: "https://[::1]:4000/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.port = tt.port
+
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Host = tt.host
+			rr := httptest.NewRecorder()
+
+			app.redirectToHTTPS(rr, r)
+
+			if rr.Code != http.StatusMovedPermanently {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusMovedPermanently)
+			}
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("got Location %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 关闭HTTP/2时TLSNextProto必须是非nil的空map，否则ServeTLS仍然会协商h2
+func TestConfigureHTTP2Disabled(t *testing.T) {
+	app := &application{}
+	app.config.tls.certFile = "cert.pem"
+
+	srv := &http.Server{}
+	tracker, err := app.configureHTTP2(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.TLSNextProto == nil || len(srv.TLSNextProto) != 0 {
+		t.Errorf("got TLSNextProto %v; want a non-nil empty map", srv.TLSNextProto)
+	}
+	if tracker != nil {
+		t.Error("got an h2c tracker; want nil")
+	}
+}
+
+// Shutdown不等待h2c连接中的请求就返回，h2cTracker.wait会等到这些请求结束
+func TestH2CGracefulShutdown(t *testing.T) {
+	app := &application{}
+	app.config.http2 = true
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	tracker, err := app.configureHTTP2(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker == nil {
+		t.Fatal("got a nil h2c tracker")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	// 使用prior knowledge的h2c客户端
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Get("http://" + ln.Addr().String())
+		done <- result{resp, err}
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- tracker.wait(ctx)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("wait returned while an h2c request was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-waited; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	defer res.resp.Body.Close()
+	if res.resp.StatusCode != http.StatusOK || res.resp.ProtoMajor != 2 {
+		t.Errorf("got %s %d; want HTTP/2.0 200", res.resp.Proto, res.resp.StatusCode)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+)
+
+// 管理后台使用的汇总统计信息
+func (app *application) showStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.models.Stats.Get(r.Context(), 10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
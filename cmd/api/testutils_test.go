@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/broker"
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/jsonlog"
+)
+
+// 下面的mock模型只实现测试用到的方法，调用其他方法时会因为嵌入的接口为nil而panic，
+// 需要时在这里补充对应的方法
+
+type mockMovieModel struct {
+	data.MovieModelInterface
+	movies map[int64]*data.Movie
+	// 被软删除的movie
+	deleted map[int64]*data.Movie
+	// 大于0时，movies中已经有这么多movie之后Insert返回错误
+	insertLimit int
+}
+
+func (m *mockMovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+	if m.insertLimit > 0 && len(m.movies) >= m.insertLimit {
+		return errors.New("insert failed")
+	}
+	movie.ID = int64(len(m.movies) + len(m.deleted) + 1)
+	movie.Version = 1
+	m.movies[movie.ID] = movie
+	return nil
+}
+
+func (m *mockMovieModel) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	movie, ok := m.movies[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	return movie, nil
+}
+
+// 忽略过滤条件，删除所有movie
+func (m *mockMovieModel) DeleteAll(ctx context.Context, title string, genres []string) (int64, error) {
+	ids, err := m.DeleteAllIDs(ctx, title, genres)
+	return int64(len(ids)), err
+}
+
+// 与DeleteAll相同，按id顺序返回被删除的movie
+func (m *mockMovieModel) DeleteAllIDs(ctx context.Context, title string, genres []string) ([]int64, error) {
+	ids := []int64{}
+	for id, movie := range m.movies {
+		ids = append(ids, id)
+		m.deleted[id] = movie
+		delete(m.movies, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (m *mockMovieModel) GetForUpdate(ctx context.Context, id int64) (*data.Movie, error) {
+	return m.Get(ctx, id)
+}
+
+func (m *mockMovieModel) Restore(ctx context.Context, id int64) (*data.Movie, error) {
+	if _, ok := m.movies[id]; ok {
+		return nil, data.ErrMovieNotDeleted
+	}
+	movie, ok := m.deleted[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	delete(m.deleted, id)
+	m.movies[id] = movie
+	return movie, nil
+}
+
+// 返回movies中使用了每个类型的movie数量
+func (m *mockMovieModel) GetGenreCounts(ctx context.Context, genres []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, genre := range genres {
+		counts[genre] = 0
+		for _, movie := range m.movies {
+			for _, g := range movie.Genres {
+				if g == genre {
+					counts[genre]++
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// 通过认证令牌的明文查找用户
+type mockUserModel struct {
+	data.UserModelInterface
+	tokens map[string]*data.User
+	// 认证以外的令牌，键为scope和明文
+	scoped map[[2]string]*data.User
+}
+
+func (m *mockUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	user, ok := m.tokens[tokenPlaintext]
+	if tokenScope != data.ScopeAuthentication {
+		user, ok = m.scoped[[2]string{tokenScope, tokenPlaintext}]
+	}
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+// 在已经添加的测试用户中按邮件查找
+func (m *mockUserModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	for _, user := range m.tokens {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+// 用户都是指针，调用方已经修改了其中的字段，这里只需要增加版本号
+func (m *mockUserModel) Update(ctx context.Context, user *data.User) error {
+	user.Version++
+	return nil
+}
+
+// 按id顺序返回所有用户，不支持搜索和排序
+func (m *mockUserModel) GetAll(ctx context.Context, search string, activated *bool, filters data.Filters) ([]*data.User, data.Metadata, error) {
+	users := []*data.User{}
+	for _, user := range m.tokens {
+		if activated == nil || user.Activated == *activated {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users, data.Metadata{}, nil
+}
+
+type mockPermissionModel struct {
+	data.PermissionModelInterface
+	permissions map[int64]data.Permissions
+	// 记录读取权限列表的次数
+	loads int
+}
+
+func (m *mockPermissionModel) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+	m.loads++
+	return m.permissions[userID], nil
+}
+
+// 按用户id和scope保存令牌，令牌中没有明文
+type mockTokenModel struct {
+	data.TokenModelInterface
+	tokens []*data.Token
+	// 令牌的明文保存在mockUserModel中
+	users *mockUserModel
+}
+
+// 新令牌的明文按顺序生成，认证以外的令牌记录在mockUserModel.scoped中
+func (m *mockTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	var user *data.User
+	for _, u := range m.users.tokens {
+		if u.ID == userID {
+			user = u
+		}
+	}
+
+	token := &data.Token{
+		Plaintext: fmt.Sprintf("T%025d", len(m.users.scoped)+1),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+	m.users.scoped[[2]string{scope, token.Plaintext}] = user
+	return token, nil
+}
+
+func (m *mockTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	for key, user := range m.users.scoped {
+		if key[0] == scope && user.ID == userID {
+			delete(m.users.scoped, key)
+		}
+	}
+	return nil
+}
+
+// 删除该用户的激活令牌，被使用的令牌改为墓碑
+func (m *mockTokenModel) MarkActivationUsed(ctx context.Context, tokenPlaintext string, userID int64) error {
+	used := m.users.scoped[[2]string{data.ScopeActivation, tokenPlaintext}]
+	m.DeleteAllForUser(ctx, data.ScopeActivation, userID)
+	m.users.scoped[[2]string{data.ScopeActivationUsed, tokenPlaintext}] = used
+	return nil
+}
+
+// 按创建时间倒序排列，忽略filters中的排序字段，只分页
+func (m *mockTokenModel) GetAllForUser(ctx context.Context, scope string, userID int64, filters data.Filters) ([]*data.Token, data.Metadata, error) {
+	tokens := []*data.Token{}
+	for _, token := range m.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+
+	total := len(tokens)
+	if total == 0 {
+		return tokens, data.Metadata{}, nil
+	}
+
+	start := min((filters.Page-1)*filters.PageSize, total)
+	end := min(start+filters.PageSize, total)
+
+	metadata := data.Metadata{
+		CurrentPage:  filters.Page,
+		PageSize:     filters.PageSize,
+		FirstPage:    1,
+		LastPage:     (total + filters.PageSize - 1) / filters.PageSize,
+		TotalRecords: total,
+	}
+
+	return tokens[start:end], metadata, nil
+}
+
+// 记录加入发件队列的邮件
+type mockEmailModel struct {
+	data.EmailModelInterface
+	emails []*data.Email
+}
+
+func (m *mockEmailModel) Insert(ctx context.Context, email *data.Email) error {
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+// 记录所有发送过的邮件，不连接SMTP服务器
+type mockMailer struct {
+	mu   sync.Mutex
+	sent []mockEmail
+}
+
+type mockEmail struct {
+	recipient    string
+	templateFile string
+	data         interface{}
+}
+
+func (m *mockMailer) Send(recipient, templateFile string, data interface{}) error {
+	return m.SendContext(context.Background(), recipient, templateFile, data)
+}
+
+func (m *mockMailer) SendContext(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, mockEmail{recipient: recipient, templateFile: templateFile, data: data})
+	return nil
+}
+
+// newTestApplication 返回使用mock模型和mock邮件发送器的application，日志被丢弃，
+// 配置中的规则使用默认值，测试可以在调用routes之前修改config
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := &application{
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		mailer:   &mockMailer{},
+		shutdown: make(chan struct{}),
+		events:   broker.New(64),
+	}
+
+	app.config.env = "testing"
+	app.config.passwordPolicy = data.DefaultPasswordPolicy
+	app.config.movieRules = data.DefaultMovieRules
+
+	app.models.Movies = &mockMovieModel{movies: make(map[int64]*data.Movie), deleted: make(map[int64]*data.Movie)}
+	users := &mockUserModel{tokens: make(map[string]*data.User), scoped: make(map[[2]string]*data.User)}
+	app.models.Users = users
+	app.models.Permissions = &mockPermissionModel{permissions: make(map[int64]data.Permissions)}
+	app.models.Tokens = &mockTokenModel{users: users}
+	app.models.Emails = &mockEmailModel{}
+
+	return app
+}
+
+// addTestUser 添加一个已激活的用户并授予指定的权限，返回可以放在Authorization头中的令牌
+func addTestUser(app *application, permissions ...string) string {
+	users := app.models.Users.(*mockUserModel)
+
+	user := &data.User{
+		ID:        int64(len(users.tokens) + 1),
+		Name:      "Test User",
+		Activated: true,
+	}
+	user.Email = fmt.Sprintf("user%d@example.com", user.ID)
+
+	// 令牌只需要满足26个字符的格式要求
+	token := fmt.Sprintf("%026d", user.ID)
+	users.tokens[token] = user
+
+	app.models.Permissions.(*mockPermissionModel).permissions[user.ID] = permissions
+
+	return token
+}
+
+// testServer 在真实的HTTP服务器上运行完整的中间件链和路由
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// do 发送请求并返回状态码、响应头和响应体，headers可以为nil
+func (ts *testServer) do(t *testing.T, method, urlPath string, headers http.Header, body string) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	respBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, string(respBody)
+}
+
+func (ts *testServer) get(t *testing.T, urlPath string, headers http.Header) (int, http.Header, string) {
+	t.Helper()
+	return ts.do(t, http.MethodGet, urlPath, headers, "")
+}
+
+func (ts *testServer) post(t *testing.T, urlPath string, headers http.Header, body string) (int, http.Header, string) {
+	t.Helper()
+	return ts.do(t, http.MethodPost, urlPath, headers, body)
+}
+
+// 返回带有Bearer令牌的请求头
+func authHeader(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
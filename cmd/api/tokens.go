@@ -21,21 +21,39 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// 登录失败计数同样按小写后的地址统计
+	input.Email = data.NormalizeEmail(input.Email)
+
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	// 登录时只检查默认的长度规则，收紧密码策略之后已有用户仍然可以登录
+	data.ValidatePasswordPlaintext(v, input.Password, data.DefaultPasswordPolicy)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	ip := app.clientIP(r)
+
+	// 这个IP对该账户连续登录失败次数过多，还在锁定期内
+	if app.loginLimiter != nil {
+		if remaining := app.loginLimiter.lockedFor(input.Email, ip); remaining > 0 {
+			app.accountLockedResponse(w, r, remaining)
+			return
+		}
+	}
+
 	// 通过邮件获取用户
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			// 不存在的邮件同样计入失败次数，否则只有存在的账户会被锁定，可以据此枚举账户
+			if app.loginLimiter != nil {
+				app.loginLimiter.fail(input.Email, ip)
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -50,19 +68,41 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		if app.loginLimiter != nil {
+			app.loginLimiter.fail(input.Email, ip)
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
+	// 登录成功，清除失败记录
+	if app.loginLimiter != nil {
+		app.loginLimiter.reset(input.Email, ip)
+	}
+
 	// 生成一个新的authentication token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// 发送201Created状态码
-	err = app.writeJSON(w, http.StatusCreated, envelop{"authentication_token": token}, nil)
+	// 如果配置了认证cookie，同时把令牌写入cookie中，方便浏览器客户端使用
+	if app.config.cookie.name != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     app.config.cookie.name,
+			Value:    token.Plaintext,
+			Path:     "/",
+			Expires:  token.Expiry,
+			Secure:   app.config.cookie.secure,
+			HttpOnly: app.config.cookie.httpOnly,
+			SameSite: app.config.cookie.sameSite,
+		})
+	}
+
+	// 发送201Created状态码，同时返回用户信息，客户端登录后不需要再单独请求一次用户资料。
+	// User的JSON序列化中不包含密码
+	err = app.writeJSON(w, http.StatusCreated, envelop{"authentication_token": token, "user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -88,7 +128,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -108,23 +148,21 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Create a new activation token
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// 使用后台goroutine同样给用户发送邮件来激活用户
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+	// 同样将激活邮件加入发件队列
+	err = app.enqueueEmail(r.Context(), user.Email, "token_activation.tmpl", map[string]interface{}{
+		"activationToken": token.Plaintext,
+		"activationURL":   app.activationURL(token.Plaintext),
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Send 202 AC
 	env := envelop{"message": "an email will be sent to you containing activation instructions"}
@@ -134,3 +172,63 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// 已激活的用户请求重新验证邮件地址，令牌发送到账户当前的邮件地址。
+// 通过PUT /v1/users/verified提交令牌后刷新verified_at，之后可以再次访问要求最近验证过的接口
+func (app *application) createVerificationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// 同一时间只保留最新的一个验证令牌
+	err := app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeVerification, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, time.Hour, data.ScopeVerification)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.enqueueEmail(r.Context(), user.Email, "token_verification.tmpl", map[string]interface{}{
+		"verificationToken": token.Plaintext,
+		"verificationURL":   app.verificationURL(token.Plaintext),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{"message": "an email will be sent to you containing verification instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 分页列出当前用户未过期的身份认证令牌，用于查看在哪些地方登录过
+func (app *application) listAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	filters := app.readFilters(r.URL.Query(), "-created_at", data.TokenSortSafelist, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, metadata, err := app.models.Tokens.GetAllForUser(r.Context(), data.ScopeAuthentication, user.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"tokens": tokens, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
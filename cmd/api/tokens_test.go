@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+)
+
+func TestListAuthenticationTokensHandler(t *testing.T) {
+	app := newTestApplication(t)
+	token := addTestUser(app)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		app.models.Tokens.(*mockTokenModel).tokens = append(app.models.Tokens.(*mockTokenModel).tokens, &data.Token{
+			UserID:    1,
+			Scope:     data.ScopeAuthentication,
+			CreatedAt: now.Add(-time.Duration(i) * time.Hour),
+			Expiry:    now.Add(time.Hour),
+		})
+	}
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.get(t, "/v1/tokens/authentication?page=2&page_size=2", authHeader(token))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+
+	var resp struct {
+		Tokens   []*data.Token `json:"tokens"`
+		Metadata data.Metadata `json:"metadata"`
+	}
+	err := json.Unmarshal([]byte(body), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Tokens) != 1 {
+		t.Errorf("got %d tokens; want 1", len(resp.Tokens))
+	}
+	want := data.Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3}
+	if resp.Metadata != want {
+		t.Errorf("got metadata %+v; want %+v", resp.Metadata, want)
+	}
+
+	// 与其他列表接口一样检查分页参数和排序字段
+	for _, query := range []string{"?page=0", "?page_size=101", "?page=x", "?sort=hash"} {
+		status, _, body := ts.get(t, "/v1/tokens/authentication"+query, authHeader(token))
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d; want %d: %s", query, status, http.StatusUnprocessableEntity, body)
+		}
+	}
+}
+
+// 不存在的邮件与存在的邮件一样会被锁定，不能通过401和429的区别枚举账户
+func TestCreateAuthenticationTokenLockoutUnknownEmail(t *testing.T) {
+	app := newTestApplication(t)
+	app.loginLimiter = newLoginLimiter(3, time.Minute)
+
+	ts := newTestServer(t, app.routes())
+
+	body := `{"email": "nobody@example.com", "password": "pa55word1234"}`
+	for i := 0; i < 3; i++ {
+		status, _, resp := ts.post(t, "/v1/tokens/authentication", nil, body)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %d; want %d: %s", i+1, status, http.StatusUnauthorized, resp)
+		}
+	}
+
+	status, header, resp := ts.post(t, "/v1/tokens/authentication", nil, body)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want %d: %s", status, http.StatusTooManyRequests, resp)
+	}
+	if header.Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+// 失败次数按(邮件, IP)统计，其他IP不受影响，不能用来锁住账户的主人
+func TestLoginLimiterPerIP(t *testing.T) {
+	l := newLoginLimiter(2, time.Minute)
+
+	l.fail("Alice@Example.com", "192.0.2.1")
+	l.fail("alice@example.com", "192.0.2.1")
+
+	if l.lockedFor("alice@example.com", "192.0.2.1") == 0 {
+		t.Error("attacker IP was not locked")
+	}
+	if remaining := l.lockedFor("alice@example.com", "192.0.2.2"); remaining != 0 {
+		t.Errorf("other IP locked for %s; want 0", remaining)
+	}
+}
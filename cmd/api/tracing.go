@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 所有span使用的instrumentation名称
+const tracerName = "github.com/LTXWorld/greenLight_copy"
+
+// 创建通过OTLP/HTTP导出span的TracerProvider，endpoint是完整的URL，例如http://localhost:4318。
+// 同时注册W3C trace context传播器，使tracing中间件能够延续上游服务的trace
+func newTracerProvider(ctx context.Context, endpoint, env string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "greenlight"),
+		attribute.String("deployment.environment", env),
+	)
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp, nil
+}
+
+// 为每个请求创建一个span，父span取自请求头中的traceparent。只在配置了-otel-endpoint时加入中间件链
+func (app *application) tracing(next http.Handler) http.Handler {
+	propagator := otel.GetTextMapPropagator()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		// span名称只包含方法，避免路径中的id导致名称数量无限增长
+		ctx, span := app.tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("user_agent.original", r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", metrics.Code))
+		if metrics.Code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(metrics.Code))
+		}
+	})
+}
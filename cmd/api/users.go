@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/LTXWorld/greenLight_copy/internal/data"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -40,13 +42,33 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 	// Validate the user struct and return the error messages to the client if any of
 	// the checks fail.
-	if data.ValidateUser(v, user); !v.Valid() {
+	if data.ValidateUser(v, user, app.config.passwordPolicy); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Insert the user data into database
-	err = app.models.Users.Insert(user)
+	if app.checkBreachedPassword(r, v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// 将欢迎邮件加入发件队列，由后台worker发送，进程崩溃也不会丢失
+	// 我们有很多要传给email的模版动态数据,见tmpl文件中的{{.activationToken}}等，所以创建一个map保存
+	welcome := func(token *data.Token) *data.Email {
+		return &data.Email{
+			Recipient: user.Email,
+			Template:  "user_welcome.tmpl",
+			Data: map[string]interface{}{
+				"activationToken": token.Plaintext,
+				"activationURL":   app.activationURL(token.Plaintext),
+				"userID":          user.ID,
+			},
+		}
+	}
+
+	// 在同一个事务中插入用户、添加movies:read权限、产生激活令牌并把欢迎邮件加入队列，
+	// 避免留下没有权限、没有令牌或者永远收不到激活邮件的用户
+	_, err = app.models.RegisterUser(r.Context(), user, 3*24*time.Hour, welcome, "movies:read")
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -58,47 +80,91 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// 为新用户添加movies:read权限
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	// Write a JSON response containing the user data with the 202 Accepted status code
+	// 意味着请求已被接受处理，但是处理并未完成(发邮件可能还在发)
+	err = app.writeJSON(w, http.StatusAccepted, envelop{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
 
-	// 在用户记录创建完成之后，为其产生一个新的激活令牌并插入进tokens表中
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+}
+
+// 激活用户处理器
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// 将发送邮件的逻辑放在后台线程里面，可以不等发送完成就可以向用户发送后面的JSON响应
-	app.background(func() {
-		// 我们有很多要传给email的模版动态数据,见tmpl文件中的{{.activationToken}}等，所以创建一个map保存
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
+	// Retrieve the details of the user associated with the token
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.activationTokenNotFound(w, r, input.TokenPlaintext, v)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
-		// Call the Send() method on Mailer, passing the user's email address,name of the template file
-		// and the User struct containing the new user's data
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		return
+	}
+
+	// 用户已经通过其他激活令牌激活过，同样作废这个令牌
+	if user.Activated {
+		err = app.models.Tokens.MarkActivationUsed(r.Context(), input.TokenPlaintext, user.ID)
 		if err != nil {
-			// 将serverErrorResponse换掉，因为发邮件失败并不意味着用户创建失败
-			app.logger.PrintError(err, nil)
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-	})
 
-	// Write a JSON response containing the user data with the 202 Accepted status code
-	// 意味着请求已被接受处理，但是处理并未完成(发邮件可能还在发)
-	err = app.writeJSON(w, http.StatusAccepted, envelop{"user": user}, nil)
+		app.alreadyActivatedResponse(w, r)
+		return
+	}
+
+	// Update the user's activation status，同时记录这次邮件验证的时间
+	now := time.Now()
+	user.Activated = true
+	user.VerifiedAt = &now
+
+	// Save the updated user record in our database
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// 删除该用户所有的激活令牌，只留下一个短期的墓碑用来识别重复的激活请求
+	err = app.models.Tokens.MarkActivationUsed(r.Context(), input.TokenPlaintext, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
+	// Send the updated user details to the client in a JSON response
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
-// 激活用户处理器
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+// 提交重新验证邮件地址的令牌，刷新verified_at
+func (app *application) verifyUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		TokenPlaintext string `json:"token"`
 	}
@@ -116,12 +182,11 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Retrieve the details of the user associated with the token
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeVerification, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", "invalid or expired verification token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -129,11 +194,10 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Update the user's activation status
-	user.Activated = true
+	now := time.Now()
+	user.VerifiedAt = &now
 
-	// Save the updated user record in our database
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -144,16 +208,222 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// 用户激活成功后，删除所有其相关的激活tokens
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeVerification, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Send the updated user details to the client in a JSON response
 	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// 激活令牌不存在时，如果是刚刚使用过的令牌(还有墓碑)就返回已经激活的提示，否则返回令牌无效的错误
+func (app *application) activationTokenNotFound(w http.ResponseWriter, r *http.Request, tokenPlaintext string, v *validator.Validator) {
+	_, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivationUsed, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.alreadyActivatedResponse(w, r)
+}
+
+// 重复激活时返回成功，但不包含任何用户数据：拿到旧令牌的人不应该因此看到用户的资料
+func (app *application) alreadyActivatedResponse(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelop{"message": "user has already been activated"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 管理员分页查看用户，可以按name或email搜索，以及按激活状态过滤
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	search := app.readString(qs, "search", "")
+
+	// activated不传时列出所有用户，activated=false可以找出一直没有验证邮件的用户
+	activated := app.readBool(qs, "activated", v)
+
+	// email加密后按密文排序没有意义，不允许按email排序
+	safelist := data.UserSortSafelist
+	if app.config.dataEncryptionKey != "" {
+		safelist = nil
+		for _, s := range data.UserSortSafelist {
+			if strings.TrimPrefix(s, "-") != "email" {
+				safelist = append(safelist, s)
+			}
+		}
+	}
+
+	filters := app.readFilters(qs, "id", safelist, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), search, activated, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 管理员在邮件无法送达时手动激活用户，同时删除该用户未使用的激活令牌。
+// 已经激活的用户直接返回，不做修改
+func (app *application) forceActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		err = app.models.ActivateUser(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 修改当前用户的资料。请求体中可以带上读取时得到的version，与当前记录不一致时返回409，
+// 不带version时仍然依靠Update中的version检查防止并发修改
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name    *string `json:"name"`
+		Version *int    `json:"version"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Version != nil && *input.Version != user.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user, app.config.passwordPolicy); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 导出当前用户的所有数据，用于数据主体访问请求(GDPR)。
+// 包括用户资料，权限以及令牌的创建和过期时间；密码哈希和令牌哈希的json标签都是"-"，不会出现在导出中。
+// movie目前没有所有者，所以不包括movie
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// 导出需要全部令牌，按最大的页大小逐页读取
+	tokens := make(map[string][]*data.Token)
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeActivation} {
+		tokens[scope] = []*data.Token{}
+
+		filters := data.NewFilters("-created_at", data.TokenSortSafelist...)
+		filters.PageSize = 100
+
+		for {
+			page, metadata, err := app.models.Tokens.GetAllForUser(r.Context(), scope, user.ID, filters)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			tokens[scope] = append(tokens[scope], page...)
+
+			if filters.Page >= metadata.LastPage {
+				break
+			}
+			filters.Page++
+		}
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-user-%d.json"`, user.ID))
+	headers.Set("Cache-Control", "no-store")
+
+	env := envelop{
+		"export": envelop{
+			"generated_at": time.Now().UTC(),
+			"user":         user,
+			"permissions":  permissions,
+			"tokens":       tokens,
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
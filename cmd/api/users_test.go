@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+)
+
+func TestListUsersHandler(t *testing.T) {
+	app := newTestApplication(t)
+	admin := addTestUser(app, "users:read")
+	user := addTestUser(app)
+
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.get(t, "/v1/users", authHeader(admin))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", status, http.StatusOK)
+	}
+	if !strings.Contains(body, `"email":"user2@example.com"`) {
+		t.Errorf("body %q does not contain the second user", body)
+	}
+	if strings.Contains(body, "password") {
+		t.Errorf("body %q contains password fields", body)
+	}
+
+	app.models.Users.(*mockUserModel).tokens[user].Activated = false
+
+	_, _, body = ts.get(t, "/v1/users?activated=false", authHeader(admin))
+	if !strings.Contains(body, `"id":2`) || strings.Contains(body, `"id":1`) {
+		t.Errorf("activated=false: body %q should only contain the second user", body)
+	}
+
+	status, _, _ = ts.get(t, "/v1/users?activated=maybe", authHeader(admin))
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an invalid activated value; want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	// 开启email加密后不能按email排序
+	app.config.dataEncryptionKey = "key"
+	status, _, _ = ts.get(t, "/v1/users?sort=-email", authHeader(admin))
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for sort=-email with encryption; want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	status, _, _ = ts.get(t, "/v1/users", authHeader(user))
+	if status != http.StatusForbidden {
+		t.Errorf("got status %d without users:read; want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestExportCurrentUserHandler(t *testing.T) {
+	app := newTestApplication(t)
+	token := addTestUser(app, "movies:read")
+	addTestUser(app)
+
+	// 令牌中的哈希不能出现在导出中
+	app.models.Tokens.(*mockTokenModel).tokens = []*data.Token{
+		{Hash: []byte("secret-hash-1"), UserID: 1, Scope: data.ScopeAuthentication, CreatedAt: time.Now(), Expiry: time.Now().Add(time.Hour)},
+		{Hash: []byte("secret-hash-2"), UserID: 2, Scope: data.ScopeAuthentication, CreatedAt: time.Now(), Expiry: time.Now().Add(time.Hour)},
+	}
+
+	ts := newTestServer(t, app.routes())
+
+	status, header, body := ts.get(t, "/v1/users/me/export", authHeader(token))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", status, http.StatusOK)
+	}
+	if got := header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+		t.Errorf("got Content-Disposition %q; want an attachment", got)
+	}
+
+	var resp struct {
+		Export struct {
+			User        data.User                `json:"user"`
+			Permissions []string                 `json:"permissions"`
+			Tokens      map[string][]*data.Token `json:"tokens"`
+		} `json:"export"`
+	}
+	err := json.Unmarshal([]byte(body), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Export.User.Email != "user1@example.com" {
+		t.Errorf("got user %q; want user1@example.com", resp.Export.User.Email)
+	}
+	if len(resp.Export.Permissions) != 1 || resp.Export.Permissions[0] != "movies:read" {
+		t.Errorf("got permissions %v; want [movies:read]", resp.Export.Permissions)
+	}
+	if n := len(resp.Export.Tokens[data.ScopeAuthentication]); n != 1 {
+		t.Errorf("got %d authentication tokens; want 1", n)
+	}
+
+	for _, secret := range []string{"hash", "password", "user2@example.com"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("export contains %q: %s", secret, body)
+		}
+	}
+
+	status, _, _ = ts.get(t, "/v1/users/me/export", nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("anonymous export: got status %d; want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestActivateUserHandlerReplay(t *testing.T) {
+	app := newTestApplication(t)
+	addTestUser(app)
+
+	users := app.models.Users.(*mockUserModel)
+	user := users.tokens[fmt.Sprintf("%026d", 1)]
+	user.Activated = false
+
+	activationToken := strings.Repeat("A", 26)
+	users.scoped[[2]string{data.ScopeActivation, activationToken}] = user
+
+	ts := newTestServer(t, app.routes())
+	body := `{"token": "` + activationToken + `"}`
+
+	status, _, resp := ts.do(t, http.MethodPut, "/v1/users/activated", nil, body)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", status, http.StatusOK, resp)
+	}
+	if !user.Activated || user.VerifiedAt == nil {
+		t.Error("user was not activated")
+	}
+	if _, ok := users.scoped[[2]string{data.ScopeActivation, activationToken}]; ok {
+		t.Error("activation token is still valid after activation")
+	}
+
+	// 重复使用同一个令牌只返回提示，不能拿到用户的资料
+	status, _, resp = ts.do(t, http.MethodPut, "/v1/users/activated", nil, body)
+	if status != http.StatusOK {
+		t.Fatalf("replay: got status %d; want %d: %s", status, http.StatusOK, resp)
+	}
+	if !strings.Contains(resp, "already been activated") {
+		t.Errorf("replay: got body %q; want an already activated message", resp)
+	}
+	if strings.Contains(resp, "user1@example.com") || strings.Contains(resp, `"user"`) {
+		t.Errorf("replay: body %q contains user data", resp)
+	}
+
+	status, _, _ = ts.do(t, http.MethodPut, "/v1/users/activated", nil, `{"token": "`+strings.Repeat("B", 26)+`"}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("unknown token: got status %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestReverifyUser(t *testing.T) {
+	app := newTestApplication(t)
+	token := addTestUser(app)
+
+	user := app.models.Users.(*mockUserModel).tokens[token]
+	verifiedAt := time.Now().Add(-30 * 24 * time.Hour)
+	user.VerifiedAt = &verifiedAt
+
+	// 更新资料时会校验用户，需要有密码哈希
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	app.config.verificationMaxAge = 24 * time.Hour
+
+	ts := newTestServer(t, app.routes())
+
+	// 修改账户资料要求最近验证过邮件
+	status, _, body := ts.do(t, http.MethodPatch, "/v1/users/me", authHeader(token), `{"name": "New Name"}`)
+	if status != http.StatusForbidden {
+		t.Fatalf("stale verification: got status %d; want %d: %s", status, http.StatusForbidden, body)
+	}
+	if user.Name == "New Name" {
+		t.Fatal("name was updated despite the stale verification")
+	}
+
+	status, _, body = ts.post(t, "/v1/tokens/verification", authHeader(token), "")
+	if status != http.StatusAccepted {
+		t.Fatalf("request verification: got status %d; want %d: %s", status, http.StatusAccepted, body)
+	}
+
+	emails := app.models.Emails.(*mockEmailModel).emails
+	if len(emails) != 1 || emails[0].Template != "token_verification.tmpl" || emails[0].Recipient != user.Email {
+		t.Fatalf("got queued emails %+v; want one verification email to %s", emails, user.Email)
+	}
+	verificationToken := emails[0].Data["verificationToken"].(string)
+
+	status, _, body = ts.do(t, http.MethodPut, "/v1/users/verified", nil, `{"token": "`+verificationToken+`"}`)
+	if status != http.StatusOK {
+		t.Fatalf("verify: got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+
+	status, _, body = ts.do(t, http.MethodPatch, "/v1/users/me", authHeader(token), `{"name": "New Name"}`)
+	if status != http.StatusOK {
+		t.Errorf("after re-verification: got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+
+	// 令牌只能使用一次
+	status, _, _ = ts.do(t, http.MethodPut, "/v1/users/verified", nil, `{"token": "`+verificationToken+`"}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("reused token: got status %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+)
+
+// 通过Accept-Version请求头选择响应的格式，URL仍然是/v1/。没有这个请求头时使用版本1
+const (
+	apiVersion1 = 1
+	// 与版本1相比，movie的runtime是整数秒而不是"<n> mins"字符串
+	apiVersion2 = 2
+
+	latestAPIVersion = apiVersion2
+)
+
+const apiVersionContextKey = contextKey("apiVersion")
+
+// 解析Accept-Version请求头，只接受受支持的版本号，允许前后有空格
+func parseAPIVersion(header string) (int, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return apiVersion1, true
+	}
+
+	version, err := strconv.Atoi(header)
+	if err != nil || version < apiVersion1 || version > latestAPIVersion {
+		return 0, false
+	}
+
+	return version, true
+}
+
+// negotiateVersion 将请求的版本保存到上下文中，不支持的版本返回406。
+// 同一个URL的响应随Accept-Version变化，所有响应都带上Vary: Accept-Version
+func (app *application) negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept-Version")
+
+		version, ok := parseAPIVersion(r.Header.Get("Accept-Version"))
+		if !ok {
+			app.unsupportedVersionResponse(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// 返回请求的版本，没有经过negotiateVersion的请求(例如直接调用处理器的测试)为版本1
+func (app *application) contextGetAPIVersion(r *http.Request) int {
+	version, ok := r.Context().Value(apiVersionContextKey).(int)
+	if !ok {
+		return apiVersion1
+	}
+
+	return version
+}
+
+// 版本2中movie的格式，runtime是整数秒
+type movieV2 struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year,omitempty"`
+	Runtime   int32     `json:"runtime,omitempty"`
+	Genres    []string  `json:"genres,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func newMovieV2(movie *data.Movie) *movieV2 {
+	return &movieV2{
+		ID:        movie.ID,
+		CreatedAt: movie.CreatedAt,
+		UpdatedAt: movie.UpdatedAt,
+		Title:     movie.Title,
+		Year:      movie.Year,
+		Runtime:   int32(movie.Runtime),
+		Genres:    movie.Genres,
+		Version:   movie.Version,
+	}
+}
+
+// 按请求的版本返回写入响应的movie
+func (app *application) versionedMovie(r *http.Request, movie *data.Movie) interface{} {
+	if app.contextGetAPIVersion(r) == apiVersion2 {
+		return newMovieV2(movie)
+	}
+
+	return movie
+}
+
+// 与versionedMovie相同，用于movie列表
+func (app *application) versionedMovies(r *http.Request, movies []*data.Movie) interface{} {
+	if app.contextGetAPIVersion(r) == apiVersion2 {
+		v2 := make([]*movieV2, len(movies))
+		for i, movie := range movies {
+			v2[i] = newMovieV2(movie)
+		}
+		return v2
+	}
+
+	return movies
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+)
+
+func TestShowMovieHandlerAcceptVersion(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies.(*mockMovieModel).movies[1] = &data.Movie{
+		ID:      1,
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: data.Runtime(107 * 60),
+		Version: 1,
+	}
+	token := addTestUser(app, "movies:read")
+
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name          string
+		acceptVersion string
+		status        int
+		body          string
+	}{
+		{name: "default", status: http.StatusOK, body: `"runtime":"107 mins"`},
+		{name: "version 1", acceptVersion: "1", status: http.StatusOK, body: `"runtime":"107 mins"`},
+		{name: "version 2", acceptVersion: " 2 ", status: http.StatusOK, body: `"runtime":6420`},
+		{name: "unsupported", acceptVersion: "3", status: http.StatusNotAcceptable, body: `"code":"UNSUPPORTED_VERSION"`},
+		{name: "not a number", acceptVersion: "v2", status: http.StatusNotAcceptable, body: `"code":"UNSUPPORTED_VERSION"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := authHeader(token)
+			if tt.acceptVersion != "" {
+				headers.Set("Accept-Version", tt.acceptVersion)
+			}
+
+			status, header, body := ts.get(t, "/v1/movies/1", headers)
+
+			if status != tt.status {
+				t.Errorf("got status %d; want %d", status, tt.status)
+			}
+			if !strings.Contains(body, tt.body) {
+				t.Errorf("got body %q; want it to contain %q", body, tt.body)
+			}
+			if !strings.Contains(header.Get("Vary"), "Accept-Version") {
+				t.Errorf("got Vary %q; want it to contain Accept-Version", header.Get("Vary"))
+			}
+		})
+	}
+}
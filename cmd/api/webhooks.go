@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+)
+
+// 启用webhooks时必须设置签名密钥，否则接收方无法校验请求来自我们；目标地址必须是绝对的http(s)地址
+func validateWebhooks(cfg config) error {
+	if !cfg.webhooks.enabled {
+		return nil
+	}
+
+	if cfg.webhooks.secret == "" {
+		return errors.New("-webhook-secret must be set when -webhooks-enabled is set")
+	}
+
+	for _, target := range cfg.webhooks.urls {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid -webhook-urls entry %q (must be an absolute http or https URL)", target)
+		}
+	}
+
+	return nil
+}
+
+// 是否有webhook或者WebSocket客户端在接收这个事件
+func (app *application) eventSubscribed(eventType string) bool {
+	return (app.webhooks != nil && app.webhooks.Subscribed(eventType)) || (app.events != nil && app.events.Subscribers() > 0)
+}
+
+// 在movie成功创建，更新，删除之后通知外部系统和WebSocket客户端，webhook在后台goroutine中发送，失败只记录日志不影响响应
+func (app *application) publishEvent(eventType string, data interface{}) {
+	if !app.eventSubscribed(eventType) {
+		return
+	}
+
+	payload, err := webhook.Payload(eventType, data)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"event": eventType})
+		return
+	}
+
+	if app.events != nil {
+		app.events.Publish(payload)
+	}
+
+	if app.webhooks == nil || !app.webhooks.Subscribed(eventType) {
+		return
+	}
+
+	for _, url := range app.webhooks.URLs() {
+		app.background(func() {
+			err := app.webhooks.Send(url, eventType, payload)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"event": eventType,
+					"url":   url,
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestValidateWebhooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		secret  string
+		urls    []string
+		wantErr bool
+	}{
+		{name: "disabled", urls: []string{"not a url"}},
+		{name: "valid", enabled: true, secret: "s3cret", urls: []string{"https://example.com/hook", "http://10.0.0.1:8080/hook"}},
+		{name: "missing secret", enabled: true, urls: []string{"https://example.com/hook"}, wantErr: true},
+		{name: "relative url", enabled: true, secret: "s3cret", urls: []string{"/hook"}, wantErr: true},
+		{name: "unsupported scheme", enabled: true, secret: "s3cret", urls: []string{"ftp://example.com/hook"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.webhooks.enabled = tt.enabled
+			cfg.webhooks.secret = tt.secret
+			cfg.webhooks.urls = tt.urls
+
+			err := validateWebhooks(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
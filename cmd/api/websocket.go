@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// 客户端必须提供的子协议，握手响应中只能选择一个子协议
+	websocketProtocol = "greenlight.v1"
+	// 携带令牌的子协议的前缀，完整的格式为"bearer.<token>"
+	websocketTokenPrefix = "bearer."
+	// 客户端发来的查询都很小，超过这个大小的消息直接断开连接
+	websocketMaxQueryBytes = 4096
+	// 客户端在这段时间内没有读走消息就断开连接，不让卡住的连接一直占着goroutine
+	websocketWriteTimeout = 10 * time.Second
+)
+
+// 客户端通过WebSocket发送的查询，目前只支持{"query": "movie", "id": 1}
+type websocketQuery struct {
+	Query string `json:"query"`
+	ID    int64  `json:"id"`
+}
+
+// 查询的响应，与事件区分开：事件有event字段，响应有query字段
+type websocketReply struct {
+	Query string      `json:"query"`
+	Movie interface{} `json:"movie,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// 浏览器无法为WebSocket请求设置Authorization头，令牌放在Sec-WebSocket-Protocol中。
+// 不使用查询参数，避免令牌出现在访问日志和代理日志里
+func websocketToken(r *http.Request) string {
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), websocketTokenPrefix); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// 浏览器发起的跨站WebSocket请求同样会带上cookie，只接受同源和受信任的来源。
+// 没有Origin头的请求不是来自浏览器，不需要检查
+func (app *application) websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(app.config.cors.trustedOrigins, origin) {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// GET /v1/ws 升级为WebSocket连接，推送与webhook格式相同的movie事件，并回答客户端的简单查询。
+// 认证和权限检查在升级之前由中间件完成，失败时返回普通的JSON错误响应
+func (app *application) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		app.badRequestResponse(w, r, errors.New("this endpoint requires a WebSocket upgrade"))
+		return
+	}
+
+	// HTTP/2的连接不能被劫持
+	if _, ok := w.(http.Hijacker); !ok {
+		app.badRequestResponse(w, r, errors.New("WebSocket upgrades require HTTP/1.1"))
+		return
+	}
+
+	if !app.websocketOriginAllowed(r) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !slices.Contains(config.Protocol, websocketProtocol) {
+				return errors.New("missing " + websocketProtocol + " subprotocol")
+			}
+			config.Protocol = []string{websocketProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			app.serveWebsocket(ws, r)
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+// 在连接上推送事件，直到客户端断开，订阅因为跟不上被取消，或者服务器关闭
+func (app *application) serveWebsocket(ws *websocket.Conn, r *http.Request) {
+	defer ws.Close()
+
+	// 被劫持的连接保留着服务器的读写超时，清除之后由这里管理
+	ws.SetDeadline(time.Time{})
+	ws.MaxPayloadBytes = websocketMaxQueryBytes
+
+	events, unsubscribe := app.events.Subscribe()
+	defer unsubscribe()
+
+	// 在单独的goroutine中读取并回答查询，websocket.Conn的写入是并发安全的
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			var msg []byte
+			err := websocket.Message.Receive(ws, &msg)
+			if err != nil {
+				return
+			}
+
+			err = app.websocketSend(ws, app.websocketAnswer(r, msg))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case payload, ok := <-events:
+			// 跟不上的客户端被取消订阅，断开连接让它重新连接，并通过/v1/movie-changes补上错过的修改
+			if !ok {
+				return
+			}
+			err := app.websocketSend(ws, payload)
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-app.shutdown:
+			return
+		}
+	}
+}
+
+// 发送一条文本消息，v是已经序列化的[]byte或者需要序列化为JSON的值
+func (app *application) websocketSend(ws *websocket.Conn, v interface{}) error {
+	ws.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+
+	if payload, ok := v.([]byte); ok {
+		return websocket.Message.Send(ws, string(payload))
+	}
+	return websocket.JSON.Send(ws, v)
+}
+
+// 回答一条查询，错误也作为响应返回，不会断开连接
+func (app *application) websocketAnswer(r *http.Request, msg []byte) websocketReply {
+	var query websocketQuery
+
+	err := json.Unmarshal(msg, &query)
+	if err != nil {
+		return websocketReply{Error: "body contains badly-formed JSON"}
+	}
+
+	reply := websocketReply{Query: query.Query}
+
+	switch query.Query {
+	case "movie":
+		movie, err := app.models.Movies.Get(r.Context(), query.ID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			reply.Error = "the requested resource could not be found"
+		case err != nil:
+			app.logError(r, err)
+			reply.Error = "the server encountered a problem and could not process your request"
+		default:
+			reply.Movie = app.versionedMovie(r, movie)
+		}
+	default:
+		reply.Error = "unknown query (must be movie)"
+	}
+
+	return reply
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LTXWorld/greenLight_copy/internal/data"
+	"github.com/LTXWorld/greenLight_copy/internal/webhook"
+	"golang.org/x/net/websocket"
+)
+
+// 使用与浏览器相同的方式连接：令牌放在子协议中，Origin为服务器本身
+func dialWebsocket(ts *testServer, token, origin string) (*websocket.Conn, error) {
+	if origin == "" {
+		origin = ts.URL
+	}
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws", origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{websocketProtocol, websocketTokenPrefix + token}
+
+	return websocket.DialConfig(config)
+}
+
+func TestWebsocket(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies.(*mockMovieModel).movies[1] = &data.Movie{ID: 1, Title: "Moana", Genres: []string{"animation"}, Version: 1}
+	reader := addTestUser(app, "movies:read")
+	writer := addTestUser(app, "movies:write")
+
+	ts := newTestServer(t, app.routes())
+
+	// 权限在升级之前检查
+	if _, err := dialWebsocket(ts, writer, ""); err == nil {
+		t.Fatal("connected without movies:read")
+	}
+
+	// 浏览器的跨站请求会带上cookie，不受信任的来源被拒绝
+	if _, err := dialWebsocket(ts, reader, "https://evil.example.com"); err == nil {
+		t.Fatal("connected from an untrusted origin")
+	}
+
+	ws, err := dialWebsocket(ts, reader, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	err = websocket.JSON.Send(ws, websocketQuery{Query: "movie", ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply struct {
+		Query string     `json:"query"`
+		Movie data.Movie `json:"movie"`
+		Error string     `json:"error"`
+	}
+	err = websocket.JSON.Receive(ws, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Query != "movie" || reply.Movie.Title != "Moana" || reply.Error != "" {
+		t.Fatalf("got reply %+v; want movie 1", reply)
+	}
+
+	// 收到响应时连接已经订阅了事件
+	app.publishEvent(webhook.EventMovieDeleted, envelop{"id": 1})
+
+	var event webhook.Event
+	err = websocket.JSON.Receive(ws, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhook.EventMovieDeleted {
+		t.Errorf("got event %q; want %q", event.Type, webhook.EventMovieDeleted)
+	}
+
+	// 服务器关闭时断开连接
+	close(app.shutdown)
+
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err == nil {
+		t.Errorf("got message %q after shutdown; want the connection closed", msg)
+	}
+}
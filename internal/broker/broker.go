@@ -0,0 +1,66 @@
+// Package broker 在进程内把事件发给所有订阅者，例如WebSocket连接。
+// 发布不会阻塞：订阅者的缓冲区满了说明它跟不上，直接取消它的订阅并关闭channel，
+// 而不是悄悄丢掉其中的事件
+package broker
+
+import "sync"
+
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+	buffer      int
+}
+
+// New 返回一个Broker，buffer是每个订阅者最多可以积压的事件数
+func New(buffer int) *Broker {
+	return &Broker{
+		subscribers: make(map[chan []byte]struct{}),
+		buffer:      buffer,
+	}
+}
+
+// Subscribe 返回接收事件的channel以及取消订阅的函数。channel被关闭表示订阅已经结束，
+// 可能是调用了取消订阅的函数，也可能是订阅者跟不上被取消了
+func (b *Broker) Subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, b.buffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(ch)
+	}
+}
+
+// Subscribers 返回当前的订阅者数量，没有订阅者时调用方可以跳过序列化事件
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers)
+}
+
+// Publish 把事件发给所有订阅者，所有订阅者收到的是同一个切片，不能修改其中的内容
+func (b *Broker) Publish(payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- payload:
+		default:
+			b.remove(ch)
+		}
+	}
+}
+
+// 调用方需要持有锁，已经被移除的订阅者不会被重复关闭
+func (b *Broker) remove(ch chan []byte) {
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
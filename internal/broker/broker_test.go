@@ -0,0 +1,37 @@
+package broker
+
+import "testing"
+
+func TestPublish(t *testing.T) {
+	b := New(1)
+
+	fast, unsubscribeFast := b.Subscribe()
+	defer unsubscribeFast()
+	slow, unsubscribeSlow := b.Subscribe()
+	defer unsubscribeSlow()
+
+	b.Publish([]byte("first"))
+	if got := string(<-fast); got != "first" {
+		t.Fatalf("got %q; want %q", got, "first")
+	}
+
+	// slow没有读取第一个事件，缓冲区已满，第二个事件会取消它的订阅
+	b.Publish([]byte("second"))
+	if got := string(<-fast); got != "second" {
+		t.Fatalf("got %q; want %q", got, "second")
+	}
+
+	if got := string(<-slow); got != "first" {
+		t.Fatalf("slow subscriber: got %q; want %q", got, "first")
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("slow subscriber: channel still open after its buffer overflowed")
+	}
+
+	if n := b.Subscribers(); n != 1 {
+		t.Errorf("got %d subscribers; want 1", n)
+	}
+
+	// 已经被移除的订阅者再取消订阅不会panic
+	unsubscribeSlow()
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCiphertext = errors.New("invalid email ciphertext")
+
+// EmailCipher 对邮件地址做确定性加密：相同的邮件总是得到相同的密文，这样GetByEmail可以直接按密文查询。
+// 构造方式类似SIV：IV是明文的HMAC-SHA256前16字节，再用AES-CTR加密，解密后重新计算IV进行校验
+type EmailCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewEmailCipher 使用hex编码的32字节密钥创建EmailCipher，加密和HMAC使用从中派生的两个子密钥
+func NewEmailCipher(hexKey string) (*EmailCipher, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("data encryption key must be 32 bytes encoded as 64 hex characters")
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "greenlight email encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmailCipher{
+		block:  block,
+		macKey: deriveKey(key, "greenlight email iv"),
+	}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (c *EmailCipher) iv(plaintext string) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(plaintext))
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// Encrypt 返回hex编码的密文。邮件先转为小写，保持与citext列相同的大小写不敏感语义
+func (c *EmailCipher) Encrypt(email string) string {
+	plaintext := strings.ToLower(email)
+	iv := c.iv(plaintext)
+
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	copy(out, iv)
+	cipher.NewCTR(c.block, iv).XORKeyStream(out[aes.BlockSize:], []byte(plaintext))
+
+	return hex.EncodeToString(out)
+}
+
+// Decrypt 解密Encrypt产生的密文，并校验IV是否与解密后的明文一致
+func (c *EmailCipher) Decrypt(ciphertext string) (string, error) {
+	raw, err := hex.DecodeString(ciphertext)
+	if err != nil || len(raw) < aes.BlockSize {
+		return "", ErrInvalidCiphertext
+	}
+
+	iv := raw[:aes.BlockSize]
+	plaintext := make([]byte, len(raw)-aes.BlockSize)
+	cipher.NewCTR(c.block, iv).XORKeyStream(plaintext, raw[aes.BlockSize:])
+
+	if !hmac.Equal(iv, c.iv(string(plaintext))) {
+		return "", ErrInvalidCiphertext
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Define constants for the email status
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// Email 是发件队列中的一封邮件，Data是传给模版的动态数据，发送成功或者最终失败后会被清空
+type Email struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Recipient     string                 `json:"recipient"`
+	Template      string                 `json:"template"`
+	Data          map[string]interface{} `json:"-"`
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	SentAt        *time.Time             `json:"sent_at,omitempty"`
+}
+
+// EmailSortSafelist 发件队列只支持按id倒序列出
+var EmailSortSafelist = []string{"-id"}
+
+type EmailModel struct {
+	DB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
+	// 与UserModel使用同一个EmailCipher，设置后recipient列中保存的是密文
+	Cipher *EmailCipher
+}
+
+// 将收件人转换为数据库中保存的形式
+func (m EmailModel) encryptRecipient(recipient string) string {
+	if m.Cipher == nil {
+		return recipient
+	}
+	return m.Cipher.Encrypt(recipient)
+}
+
+// 将从数据库中读取到的收件人解密回明文
+func (m EmailModel) decryptRecipient(email *Email) error {
+	if m.Cipher == nil {
+		return nil
+	}
+
+	recipient, err := m.Cipher.Decrypt(email.Recipient)
+	if err != nil {
+		return err
+	}
+
+	email.Recipient = recipient
+	return nil
+}
+
+// Insert 将一封邮件加入发送队列
+func (m EmailModel) Insert(ctx context.Context, email *Email) error {
+	ctx, span := m.Tracer.Start(ctx, "emails.Insert")
+	defer span.End()
+	defer m.SlowQueries.track("emails.Insert")()
+
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+			INSERT INTO emails (recipient, template, data)
+			VALUES ($1, $2, $3)
+			RETURNING id, created_at, status, next_attempt_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, m.encryptRecipient(email.Recipient), email.Template, js).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Status,
+		&email.NextAttemptAt,
+	)
+}
+
+// Claim 取出一封到期的待发送邮件，并把下次尝试时间推迟lease，在此期间其他worker不会再取到它。
+// 如果进程在发送过程中崩溃，lease过期后这封邮件会被重新发送。没有待发送的邮件时返回ErrRecordNotFound
+func (m EmailModel) Claim(ctx context.Context, lease time.Duration) (*Email, error) {
+	ctx, span := m.Tracer.Start(ctx, "emails.Claim")
+	defer span.End()
+	defer m.SlowQueries.track("emails.Claim")()
+
+	query := `
+			UPDATE emails
+			SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * interval '1 second'
+			WHERE id = (
+				SELECT id FROM emails
+				WHERE status = 'pending' AND next_attempt_at <= NOW()
+				ORDER BY id
+				FOR UPDATE SKIP LOCKED
+				LIMIT 1
+			)
+			RETURNING id, created_at, recipient, template, data, status, attempts, last_error, next_attempt_at, sent_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var email Email
+	var js []byte
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds()).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Template,
+		&js,
+		&email.Status,
+		&email.Attempts,
+		&email.LastError,
+		&email.NextAttemptAt,
+		&email.SentAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = m.decryptRecipient(&email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// MarkSent 记录发送成功，同时清空其中可能包含令牌明文的模版数据
+func (m EmailModel) MarkSent(ctx context.Context, id int64) error {
+	ctx, span := m.Tracer.Start(ctx, "emails.MarkSent")
+	defer span.End()
+	defer m.SlowQueries.track("emails.MarkSent")()
+
+	query := `
+			UPDATE emails
+			SET status = 'sent', sent_at = NOW(), data = '{}', last_error = ''
+			WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed 记录一次发送失败，尝试次数达到maxAttempts后状态变为failed并清空模版数据，否则在backoff之后重试
+func (m EmailModel) MarkFailed(ctx context.Context, email *Email, sendErr error, maxAttempts int, backoff time.Duration) error {
+	ctx, span := m.Tracer.Start(ctx, "emails.MarkFailed")
+	defer span.End()
+	defer m.SlowQueries.track("emails.MarkFailed")()
+
+	query := `
+			UPDATE emails
+			SET status = CASE WHEN attempts >= $2 THEN 'failed' ELSE 'pending' END,
+				data = CASE WHEN attempts >= $2 THEN '{}' ELSE data END,
+				last_error = $3,
+				next_attempt_at = NOW() + $4 * interval '1 second'
+			WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email.ID, maxAttempts, sendErr.Error(), backoff.Seconds())
+	return err
+}
+
+// GetAllByStatus 返回指定状态的邮件，最新的排在前面
+func (m EmailModel) GetAllByStatus(ctx context.Context, status string, filters Filters) ([]*Email, Metadata, error) {
+	ctx, span := m.Tracer.Start(ctx, "emails.GetAllByStatus")
+	defer span.End()
+	defer m.SlowQueries.track("emails.GetAllByStatus")()
+
+	query := `
+			SELECT count(*) OVER(), id, created_at, recipient, template, status, attempts, last_error, next_attempt_at, sent_at
+			FROM emails
+			WHERE status = $1
+			ORDER BY id DESC
+			LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.Offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Template,
+			&email.Status,
+			&email.Attempts,
+			&email.LastError,
+			&email.NextAttemptAt,
+			&email.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = m.decryptRecipient(&email)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return emails, metadata, nil
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 设置了EmailCipher时recipient以密文保存，读取时解密；最终失败的邮件会清空模版数据
+func TestEmailsEncryptRecipient(t *testing.T) {
+	db := newTestDB(t)
+
+	cipher, err := NewEmailCipher(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := NewModels(db, ModelOptions{EmailCipher: cipher})
+	ctx := context.Background()
+
+	// 清空队列，避免Claim取到其他测试留下的邮件
+	_, err = db.Exec("DELETE FROM emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM emails") })
+
+	email := &Email{
+		Recipient: "alice@example.com",
+		Template:  "user_welcome.tmpl",
+		Data:      map[string]interface{}{"activationToken": "secret"},
+	}
+	err = models.Emails.Insert(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	err = db.QueryRow("SELECT recipient FROM emails WHERE id = $1", email.ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == email.Recipient {
+		t.Errorf("recipient stored in plaintext: %q", stored)
+	}
+
+	claimed, err := models.Emails.Claim(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.Recipient != email.Recipient {
+		t.Errorf("got recipient %q; want %q", claimed.Recipient, email.Recipient)
+	}
+
+	err = models.Emails.MarkFailed(ctx, claimed, errors.New("smtp down"), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status, data string
+	err = db.QueryRow("SELECT status, data FROM emails WHERE id = $1", email.ID).Scan(&status, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != EmailFailed || data != "{}" {
+		t.Errorf("got status %q, data %s; want %q, {}", status, data, EmailFailed)
+	}
+
+	failed, _, err := models.Emails.GetAllByStatus(ctx, EmailFailed, NewFilters("-id", EmailSortSafelist...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Recipient != email.Recipient {
+		t.Errorf("got failed emails %+v; want one for %q", failed, email.Recipient)
+	}
+}
@@ -13,6 +13,17 @@ type Filters struct {
 	SortSafelist []string
 }
 
+// NewFilters 返回使用默认分页参数(第1页，每页20条)的Filters，safelist通常使用与模型定义在一起的
+// MovieSortSafelist等变量，保证同一种资源在各个入口允许的排序字段一致
+func NewFilters(defaultSort string, safelist ...string) Filters {
+	return Filters{
+		Page:         1,
+		PageSize:     20,
+		Sort:         defaultSort,
+		SortSafelist: safelist,
+	}
+}
+
 // Check the client-provided Sort field matches one of the entries in our safelist
 // and if it does, extract the column name from the Sort field by stripping the leading hyphen character
 func (f Filters) sortColumn() string {
@@ -35,6 +46,17 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// orderBy 返回ORDER BY子句的内容，排序字段的值相同时再按tiebreaker升序排列，保证分页时顺序稳定，
+// 不会有记录在相邻的两页中重复出现或者被跳过。tiebreaker必须是唯一的列，排序字段本身就是它时不再重复追加
+func (f Filters) orderBy(tiebreaker string) string {
+	column := f.sortColumn()
+	if column == tiebreaker {
+		return column + " " + f.sortDirection()
+	}
+
+	return column + " " + f.sortDirection() + ", " + tiebreaker + " ASC"
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(f.Page > 0, "page", "must be greater than zero")
@@ -49,7 +71,8 @@ func (f Filters) limit() int {
 	return f.PageSize
 }
 
-func (f Filters) offset() int {
+// Offset 返回查询使用的偏移量，处理器可以在查询之前据此拒绝太深的分页
+func (f Filters) Offset() int {
 	return (f.Page - 1) * f.PageSize // 由于在ValidateFilters中已经设置了page_size和page的最大值
 }
 
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+func TestValidateFiltersRejectsUnsafeSort(t *testing.T) {
+	filters := NewFilters("id", MovieSortSafelist...)
+	filters.Sort = "password_hash"
+
+	v := validator.New()
+	ValidateFilters(v, filters)
+
+	if v.Valid() {
+		t.Fatal("expected a validation error for an unsafe sort column")
+	}
+	if _, ok := v.Errors["sort"]; !ok {
+		t.Errorf("expected an error for the sort key, got %v", v.Errors)
+	}
+}
+
+func TestValidateFiltersAcceptsSafelistedSort(t *testing.T) {
+	filters := NewFilters("id", MovieSortSafelist...)
+	filters.Sort = "-year"
+
+	v := validator.New()
+	ValidateFilters(v, filters)
+
+	if !v.Valid() {
+		t.Fatalf("unexpected validation errors: %v", v.Errors)
+	}
+	if got := filters.sortColumn(); got != "year" {
+		t.Errorf("sortColumn() = %q; want %q", got, "year")
+	}
+	if got := filters.sortDirection(); got != "DESC" {
+		t.Errorf("sortDirection() = %q; want %q", got, "DESC")
+	}
+}
+
+func TestFiltersOrderByTiebreaker(t *testing.T) {
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{sort: "year", want: "year ASC, id ASC"},
+		{sort: "-year", want: "year DESC, id ASC"},
+		{sort: "title", want: "title ASC, id ASC"},
+		{sort: "id", want: "id ASC"},
+		{sort: "-id", want: "id DESC"},
+	}
+
+	for _, tt := range tests {
+		filters := NewFilters(tt.sort, MovieSortSafelist...)
+
+		if got := filters.orderBy("id"); got != tt.want {
+			t.Errorf("orderBy(%q) with sort %q = %q; want %q", "id", tt.sort, got, tt.want)
+		}
+	}
+}
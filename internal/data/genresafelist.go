@@ -0,0 +1,49 @@
+package data
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+)
+
+//go:embed genres.txt
+var genresFile string
+
+// DefaultGenres 是嵌入的类型列表，开启类型限制但没有指定列表时使用
+var DefaultGenres = loadGenres(genresFile)
+
+func loadGenres(file string) []string {
+	var genres []string
+
+	scanner := bufio.NewScanner(strings.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		genres = append(genres, line)
+	}
+
+	return genres
+}
+
+// InvalidGenres 返回genres中不在allowed里的类型，保持原来的顺序。allowed为nil表示不限制类型
+func InvalidGenres(genres, allowed []string) []string {
+	if allowed == nil {
+		return nil
+	}
+
+	safelist := make(map[string]bool, len(allowed))
+	for _, genre := range allowed {
+		safelist[genre] = true
+	}
+
+	var invalid []string
+	for _, genre := range genres {
+		if !safelist[genre] {
+			invalid = append(invalid, genre)
+		}
+	}
+
+	return invalid
+}
@@ -2,8 +2,14 @@ package data
 
 // 用于作为一个统一的入口点，用于管理和组织所有数据模型，app启动时可以将所有的数据模型注入到app中
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // 定义一个自定义错误，当Get寻找一个不存在于数据库中的movie时会返回
@@ -12,21 +18,225 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX 是*sql.DB和*sql.Tx共有的方法。模型通过它执行查询，同一个模型既可以直接使用连接池，也可以放进事务中使用
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// 每个模型对外提供的方法。处理器只依赖这些接口，单元测试中可以替换为不访问数据库的实现
+type MovieModelInterface interface {
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	GetForUpdate(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie, changedBy int64) error
+	AddGenre(ctx context.Context, movie *Movie, genre string, changedBy int64) error
+	RemoveGenre(ctx context.Context, movie *Movie, genre string, changedBy int64) error
+	Delete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) (*Movie, error)
+	DeleteAll(ctx context.Context, title string, genres []string) (int64, error)
+	DeleteAllIDs(ctx context.Context, title string, genres []string) ([]int64, error)
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	GetSimilar(ctx context.Context, id int64, limit int) ([]*Movie, error)
+	GetGenres(ctx context.Context) ([]GenreCount, error)
+	GetGenreCounts(ctx context.Context, genres []string) (map[string]int, error)
+	GetChanges(ctx context.Context, since int64, limit int) ([]*Movie, []int64, int64, error)
+	GetVersions(ctx context.Context, id int64, filters Filters) ([]*MovieVersion, Metadata, error)
+}
+
+type UserModelInterface interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetAll(ctx context.Context, search string, activated *bool, filters Filters) ([]*User, Metadata, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+type TokenModelInterface interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	MarkActivationUsed(ctx context.Context, tokenPlaintext string, userID int64) error
+	GetAllForUser(ctx context.Context, scope string, userID int64, filters Filters) ([]*Token, Metadata, error)
+}
+
+type PermissionModelInterface interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	EnsureCodes(ctx context.Context, codes ...string) ([]string, error)
+}
+
+type EmailModelInterface interface {
+	Insert(ctx context.Context, email *Email) error
+	Claim(ctx context.Context, lease time.Duration) (*Email, error)
+	MarkSent(ctx context.Context, id int64) error
+	MarkFailed(ctx context.Context, email *Email, sendErr error, maxAttempts int, backoff time.Duration) error
+	GetAllByStatus(ctx context.Context, status string, filters Filters) ([]*Email, Metadata, error)
+}
+
+type StatsModelInterface interface {
+	Get(ctx context.Context, topGenres int) (*Stats, error)
+}
+
 // 新建一个Models struct 包裹着MovieModel,可以向其中添加其他模型
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies      MovieModelInterface
+	Users       UserModelInterface
+	Tokens      TokenModelInterface
+	Permissions PermissionModelInterface
+	Emails      EmailModelInterface
+	Stats       StatsModelInterface
+
+	// 所有模型共用的连接池，在WithTx返回的Models中是当前的事务
+	db     DBTX
+	tracer trace.Tracer
+	// 主库和副本的预处理语句缓存，没有启用时为空
+	stmtCaches []*StmtCache
+}
+
+// ModelOptions 是创建模型时的可选配置，零值表示全部不启用
+type ModelOptions struct {
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为nil时使用noop实现
+	Tracer trace.Tracer
+	// 为nil时users.email和emails.recipient以明文保存
+	EmailCipher *EmailCipher
+	// 为nil时MovieModel.Get不使用缓存
+	MovieCache *MovieCache
+	// 只读副本，为空时所有查询都使用主库
+	Replicas []*sql.DB
+	// 缓存模型中使用的预处理语句，见StmtCache
+	PrepareStatements bool
+	// MovieModel写入时允许的最大类型数，为0时不检查
+	MaxGenres int
 }
 
 // 工厂函数，为了方便使用，写一个New方法初始化一个Modles结构体，
 // 这里传入了db，实现了依赖注入，数据库连接sql.DB注入到每个模型中——外部负责初始化数据库，通过依赖注入传入(sql.Open那里)
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, opts ModelOptions) Models {
+	tracer := opts.Tracer
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer("")
+	}
+	slowQueries := opts.SlowQueries
+
+	var stmtCaches []*StmtCache
+	// 启用预处理语句缓存时模型通过StmtCache访问连接池
+	wrap := func(db *sql.DB) DBTX {
+		if !opts.PrepareStatements {
+			return db
+		}
+		cache := NewStmtCache(db)
+		stmtCaches = append(stmtCaches, cache)
+		return cache
+	}
+
+	primary := wrap(db)
+
+	// 保持接口值为nil，而不是值为nil的*ReplicaSet，这样reader会回退到主库
+	var readDB DBTX
+	if len(opts.Replicas) > 0 {
+		var replicas []DBTX
+		for _, replica := range opts.Replicas {
+			replicas = append(replicas, wrap(replica))
+		}
+		readDB = NewReplicaSet(replicas...)
+	}
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		db:          db,
+		tracer:      tracer,
+		stmtCaches:  stmtCaches,
+		Movies:      MovieModel{DB: primary, ReadDB: readDB, Cache: opts.MovieCache, MaxGenres: opts.MaxGenres, SlowQueries: slowQueries, Tracer: tracer},
+		Users:       UserModel{DB: primary, ReadDB: readDB, Cipher: opts.EmailCipher, SlowQueries: slowQueries, Tracer: tracer},
+		Tokens:      TokenModel{DB: primary, SlowQueries: slowQueries, Tracer: tracer},
+		Permissions: PermissionModel{DB: primary, SlowQueries: slowQueries, Tracer: tracer},
+		Emails:      EmailModel{DB: primary, Cipher: opts.EmailCipher, SlowQueries: slowQueries, Tracer: tracer},
+		Stats:       StatsModel{DB: primary, SlowQueries: slowQueries, Tracer: tracer},
+	}
+}
+
+// Close 关闭缓存的预处理语句，需要在关闭连接池之前调用。连接池本身由创建它的一方关闭
+func (m Models) Close() error {
+	var firstErr error
+	for _, cache := range m.stmtCaches {
+		err := cache.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// WithTx 在一个事务中执行fn，fn收到的Models中所有模型都使用这个事务，fn返回nil时提交，否则回滚。
+// 已经在事务中时直接复用外层的事务。注意MovieModel的缓存会在外层事务提交之前就失效
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	return inTx(ctx, m.db, func(tx *sql.Tx) error {
+		return fn(m.withDB(tx))
+	})
+}
+
+// 返回所有基于SQL的模型都使用db的副本，缓存、加密等其他配置保持不变。
+// 读取也使用db，事务中不会读到副本上的旧数据。
+// 测试中替换进来的其他实现原样保留
+func (m Models) withDB(db DBTX) Models {
+	m.db = db
+	if movies, ok := m.Movies.(MovieModel); ok {
+		movies.DB = db
+		movies.ReadDB = nil
+		m.Movies = movies
+	}
+	if users, ok := m.Users.(UserModel); ok {
+		users.DB = db
+		users.ReadDB = nil
+		m.Users = users
+	}
+	if tokens, ok := m.Tokens.(TokenModel); ok {
+		tokens.DB = db
+		m.Tokens = tokens
+	}
+	if permissions, ok := m.Permissions.(PermissionModel); ok {
+		permissions.DB = db
+		m.Permissions = permissions
+	}
+	if emails, ok := m.Emails.(EmailModel); ok {
+		emails.DB = db
+		m.Emails = emails
+	}
+	if stats, ok := m.Stats.(StatsModel); ok {
+		stats.DB = db
+		m.Stats = stats
+	}
+	return m
+}
+
+// inTx 在db上以事务的方式执行fn。db是连接池时开启新的事务，fn成功后提交；
+// db本身已经是事务时直接使用，由开启它的一方负责提交或者回滚
+func inTx(ctx context.Context, db DBTX, fn func(tx *sql.Tx) error) error {
+	switch db := db.(type) {
+	case *sql.Tx:
+		return fn(db)
+	// 事务中的语句不使用缓存
+	case *StmtCache:
+		return inTx(ctx, db.db, fn)
+	case *sql.DB:
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	default:
+		return fmt.Errorf("data: cannot start a transaction on %T", db)
 	}
 }
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MovieCache 是放在MovieModel.Get前面的LRU缓存，条目超过ttl后失效。
+// 存入和取出的都是副本，调用方修改返回的movie不会影响缓存中的数据
+type MovieCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[int64]*list.Element
+	// 每次失效时加一，Get在查询数据库前记录下来，写回缓存时如果发生了变化就放弃写入，
+	// 避免并发的Update/Delete之后又把旧数据写回缓存
+	epoch  uint64
+	hits   int64
+	misses int64
+}
+
+type movieCacheEntry struct {
+	movie   Movie
+	expires time.Time
+}
+
+// MovieCacheStats 通过expvar发布的缓存统计信息
+type MovieCacheStats struct {
+	Size   int   `json:"size"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func NewMovieCache(capacity int, ttl time.Duration) *MovieCache {
+	return &MovieCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[int64]*list.Element),
+	}
+}
+
+// get 返回缓存中movie的副本以及当前的epoch，没有命中时返回nil
+func (c *MovieCache) get(id int64) (*Movie, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		entry := el.Value.(*movieCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.ll.MoveToFront(el)
+			c.hits++
+			return copyMovie(&entry.movie), c.epoch
+		}
+
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+
+	c.misses++
+	return nil, c.epoch
+}
+
+// set 只有在读取数据库期间没有发生失效时才写入缓存，超出容量时淘汰最久未使用的条目
+func (c *MovieCache) set(movie *Movie, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	entry := &movieCacheEntry{movie: *copyMovie(movie), expires: time.Now().Add(c.ttl)}
+
+	if el, ok := c.items[movie.ID]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[movie.ID] = c.ll.PushFront(entry)
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*movieCacheEntry).movie.ID)
+	}
+}
+
+// invalidate 删除指定id的缓存条目
+func (c *MovieCache) invalidate(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// Stats 返回当前的条目数以及命中和未命中的次数
+func (c *MovieCache) Stats() MovieCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return MovieCacheStats{
+		Size:   c.ll.Len(),
+		Hits:   c.hits,
+		Misses: c.misses,
+	}
+}
+
+// 复制movie，genres切片也需要单独复制
+func copyMovie(movie *Movie) *Movie {
+	m := *movie
+	m.Genres = append([]string(nil), movie.Genres...)
+	return &m
+}
@@ -7,75 +7,162 @@ import (
 	"fmt"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+	"slices"
+	"strings"
 	"time"
 )
 
 type Movie struct {
 	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"` // 电影的类型切片
 	Version   int32     `json:"version"`
+	ChangeSeq int64     `json:"-"` // 每次创建，更新，删除时从movies_change_seq中取得的新值，用于增量同步
 }
 
+// MovieSortSafelist 是电影列表允许的排序字段，HTTP，GraphQL和gRPC的列表接口共用
+var MovieSortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
 type MovieModel struct {
-	DB *sql.DB // 这里实现了依赖注入，注入不同的DB实现，可以更好的进行模拟测试和更换数据库驱动类型
+	DB DBTX // 这里实现了依赖注入，注入不同的DB实现，可以更好的进行模拟测试和更换数据库驱动类型
+	// 列表等只读查询使用的副本，为nil时使用DB。开启缓存时的Get，GetForUpdate以及WithPrimary的ctx读取主库
+	ReadDB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
+	// Get前面的可选缓存，为nil时每次都查询数据库
+	Cache *MovieCache
+	// Insert和Update允许的最大类型数，为0时不检查。
+	// 数据库的genres_length_check只要求至少一个类型(见000016)，上限由启动参数决定，只能在这里检查
+	MaxGenres int
+}
+
+// ErrMovieNotDeleted 是Restore一个没有被删除的movie时返回的错误
+var ErrMovieNotDeleted = errors.New("movie is not deleted")
+
+// ErrTooManyGenres 是写入的类型数超过MaxGenres时返回的错误。
+// 处理器在写入之前已经用ValidateMovie检查过，出现这个错误说明有绕过校验的写入路径
+var ErrTooManyGenres = errors.New("too many genres")
+
+// 在访问数据库之前检查类型数
+func (m MovieModel) checkGenres(genres []string) error {
+	if m.MaxGenres > 0 && len(genres) > m.MaxGenres {
+		return fmt.Errorf("%w: movie has %d, maximum is %d", ErrTooManyGenres, len(genres), m.MaxGenres)
+	}
+	return nil
 }
 
 // Insert 这些CRUD方法的接收者没有使用指针类型是因为——一般只有需要更改接收者结构体中的字段时（或者结构体太大复制开销大）
 // 本例中MovieModel结构体只有DB这个字段
 // Add a placeholder method for insert
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
+	ctx, span := m.Tracer.Start(ctx, "movies.Insert")
+	defer span.End()
+	defer m.SlowQueries.track("movies.Insert")()
+
+	err := m.checkGenres(movie.Genres)
+	if err != nil {
+		return err
+	}
+
 	// 插入一条新记录的SQL语句，并返回信息（Postgresql专有)
 	query := `
 			INSERT INTO movies (title, year, runtime, genres)
 			VALUES ($1, $2, $3, $4)
-			RETURNING id, created_at, version`
+			RETURNING id, created_at, updated_at, version, change_seq`
 
 	// 创建一个代表着占位符的movie中的属性切片
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
 	// Create a context with a 3-second timeout
 	// 如果数据库操作在3s内没有完成，操作自动取消，返回超时错误
-	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancle := context.WithTimeout(ctx, 3*time.Second)
 	defer cancle()
 
 	// 使用QueryRowContext方法执行,利用传入的ctx进行SQL查询，并使用Scan方法将返回值注入到movie的三个属性中
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version, &movie.ChangeSeq)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// Get 先查缓存。没有缓存时从副本读取；有缓存时从主库读取，避免把副本上落后的数据写进缓存，
+// 在整个ttl内返回更新之前的数据
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.Get")
+	defer span.End()
+	defer m.SlowQueries.track("movies.Get")()
+
 	// 健壮性判断
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
+	if m.Cache == nil {
+		return m.get(ctx, reader(ctx, m.DB, m.ReadDB), id)
+	}
+
+	// 先查缓存，epoch用于判断查询数据库期间缓存是否被失效过
+	cached, epoch := m.Cache.get(id)
+	if cached != nil {
+		return cached, nil
+	}
+
+	movie, err := m.get(ctx, m.DB, id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cache.set(movie, epoch)
+
+	return movie, nil
+}
+
+// GetForUpdate 不经过缓存和副本，直接从主库读取。用于先读取再按version更新的写操作，
+// 副本的延迟会让读到的version落后，导致不必要的编辑冲突
+func (m MovieModel) GetForUpdate(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetForUpdate")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetForUpdate")()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.get(ctx, m.DB, id)
+}
+
+// 从db中读取一部没有被删除的movie
+func (m MovieModel) get(ctx context.Context, db DBTX, id int64) (*Movie, error) {
 	// Define the SQL query for retrieving the movie data.
 	query := `
-			SELECT id, created_at, title, year, runtime, genres, version
+			SELECT id, created_at, updated_at, title, year, runtime, genres, version, change_seq
 			FROM movies
-			WHERE id = $1`
+			WHERE id = $1 AND deleted_at IS NULL`
 
 	// Declare a Movie struct to hold the data returned by the query
 	var movie Movie
 
 	// Use the context.WithTimeout() function to create a context.Context carries
 	// a 3-seconds deadline
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
 	// Execute the query using the QueryRow method
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := db.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.ChangeSeq,
 	)
 
 	// Handle any errors.
@@ -93,13 +180,24 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Update the whole record(even though you just need one filed)
-func (m MovieModel) Update(movie *Movie) error {
+// 更新前在同一个事务中将旧的版本写入movie_versions，changedBy为0时不记录修改人
+func (m MovieModel) Update(ctx context.Context, movie *Movie, changedBy int64) error {
+	ctx, span := m.Tracer.Start(ctx, "movies.Update")
+	defer span.End()
+	defer m.SlowQueries.track("movies.Update")()
+
+	err := m.checkGenres(movie.Genres)
+	if err != nil {
+		return err
+	}
+
 	// Declare the SQL query for updating the whole record and returning the new version number
 	query := `
 			UPDATE movies
-			SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-			WHERE id = $5 AND version = $6
-			RETURNING version`
+			SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1,
+				updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE id = $5 AND version = $6 AND deleted_at IS NULL
+			RETURNING version, change_seq, updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters
 	args := []interface{}{
@@ -111,37 +209,120 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version, // For the data race
 	}
 
-	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancle()
+	return m.updateWithHistory(ctx, movie, changedBy, func(ctx context.Context, tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.ChangeSeq, &movie.UpdatedAt)
+	})
+}
+
+// 在数据库中将genre追加到genres数组末尾，只更新这一列，同样通过version检查避免覆盖并发的修改。
+// 调用方负责检查genre是否已存在；追加之后超过MaxGenres时返回ErrTooManyGenres
+func (m MovieModel) AddGenre(ctx context.Context, movie *Movie, genre string, changedBy int64) error {
+	ctx, span := m.Tracer.Start(ctx, "movies.AddGenre")
+	defer span.End()
+	defer m.SlowQueries.track("movies.AddGenre")()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	// version检查保证数据库中的genres与movie.Genres相同，所以按追加之后的数量检查即可
+	err := m.checkGenres(append(slices.Clone(movie.Genres), genre))
 	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+		return err
+	}
+
+	query := `
+			UPDATE movies
+			SET genres = array_append(genres, $1), version = version + 1,
+				updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE id = $2 AND version = $3 AND deleted_at IS NULL
+			RETURNING genres, version, change_seq, updated_at`
+
+	return m.updateGenres(ctx, movie, query, genre, changedBy)
+}
+
+// 从genres数组中删除genre，其余规则与AddGenre相同
+func (m MovieModel) RemoveGenre(ctx context.Context, movie *Movie, genre string, changedBy int64) error {
+	ctx, span := m.Tracer.Start(ctx, "movies.RemoveGenre")
+	defer span.End()
+	defer m.SlowQueries.track("movies.RemoveGenre")()
+
+	query := `
+			UPDATE movies
+			SET genres = array_remove(genres, $1), version = version + 1,
+				updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE id = $2 AND version = $3 AND deleted_at IS NULL
+			RETURNING genres, version, change_seq, updated_at`
+
+	return m.updateGenres(ctx, movie, query, genre, changedBy)
+}
+
+// 执行AddGenre和RemoveGenre的更新语句，并将新的genres和version写回movie
+func (m MovieModel) updateGenres(ctx context.Context, movie *Movie, query, genre string, changedBy int64) error {
+	return m.updateWithHistory(ctx, movie, changedBy, func(ctx context.Context, tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, query, genre, movie.ID, movie.Version).Scan(
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.ChangeSeq,
+			&movie.UpdatedAt,
+		)
+	})
+}
+
+// 在一个事务中先保存movie当前的版本，再执行update，update没有匹配到记录时返回ErrEditConflict
+func (m MovieModel) updateWithHistory(ctx context.Context, movie *Movie, changedBy int64, update func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// 无论更新成功还是发生编辑冲突，缓存中的这条记录都可能已经过期。defer保证在事务结束之后才失效
+	if m.Cache != nil {
+		defer m.Cache.invalidate(movie.ID)
+	}
+
+	return inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := saveMovieVersion(ctx, tx, movie.ID, movie.Version, changedBy)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = update(ctx, tx)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 // 删除指定id的电影，并根据返回的影响行数来确定是否成功删除
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := m.Tracer.Start(ctx, "movies.Delete")
+	defer span.End()
+	defer m.SlowQueries.track("movies.Delete")()
+
 	// Return an ErrRecordNotFound error if the movie ID is less than 1
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `DELETE FROM movies WHERE id = $1`
+	// 软删除，保留一条墓碑记录，增量同步时客户端才能知道这条记录被删除了
+	query := `
+			UPDATE movies
+			SET deleted_at = NOW(), updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE id = $1 AND deleted_at IS NULL`
 
-	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancle := context.WithTimeout(ctx, 3*time.Second)
 	defer cancle()
 
 	// Execute the SQL query using the Exec method
 	// 执行不返回任何行记录的SQL，返回的是sq.Result接口对象，包括了LastInsertId和RowsAffected方法
 	result, err := m.DB.ExecContext(ctx, query, id)
+
+	if m.Cache != nil {
+		m.Cache.invalidate(id)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -161,22 +342,149 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// Restore 撤销软删除并返回恢复后的movie。恢复同样分配新的change_seq，增量同步的客户端会重新收到这条记录。
+// movie不存在时返回ErrRecordNotFound，没有被删除时返回ErrMovieNotDeleted
+func (m MovieModel) Restore(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.Restore")
+	defer span.End()
+	defer m.SlowQueries.track("movies.Restore")()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+			UPDATE movies
+			SET deleted_at = NULL, updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE id = $1 AND deleted_at IS NOT NULL
+			RETURNING id, created_at, updated_at, title, year, runtime, genres, version, change_seq`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var movie Movie
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+		&movie.ChangeSeq,
+	)
+
+	// 缓存中不会有被删除的movie，失效是为了让并发的Get放弃写回
+	if m.Cache != nil {
+		m.Cache.invalidate(id)
+	}
+
+	if err == nil {
+		return &movie, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// 没有更新任何记录，区分movie不存在和没有被删除两种情况
+	var exists bool
+	err = m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1)`, id).Scan(&exists)
+	switch {
+	case err != nil:
+		return nil, err
+	case exists:
+		return nil, ErrMovieNotDeleted
+	default:
+		return nil, ErrRecordNotFound
+	}
+}
+
+// DeleteAll 在一个事务中删除所有满足与GetAll相同过滤条件的movie，返回被删除的数量
+func (m MovieModel) DeleteAll(ctx context.Context, title string, genres []string) (int64, error) {
+	ids, err := m.DeleteAllIDs(ctx, title, genres)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
+
+// DeleteAllIDs 与DeleteAll相同，但返回被删除的movie的id，供需要逐个通知的调用方使用
+func (m MovieModel) DeleteAllIDs(ctx context.Context, title string, genres []string) ([]int64, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.DeleteAllIDs")
+	defer span.End()
+	defer m.SlowQueries.track("movies.DeleteAllIDs")()
+
+	query := `
+			UPDATE movies
+			SET deleted_at = NOW(), updated_at = NOW(), change_seq = nextval('movies_change_seq')
+			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+			AND (genres @> $2 OR $2 = '{}')
+			AND deleted_at IS NULL
+			RETURNING id`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// 记录被删除的id，提交之后用来清理缓存，并返回给调用方
+	ids := []int64{}
+
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, title, pq.Array(genres))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+
+			err := rows.Scan(&id)
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, id)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Cache != nil {
+		for _, id := range ids {
+			m.Cache.invalidate(id)
+		}
+	}
+
+	return ids, nil
+}
+
 // GetAll 根据用户的需求：标题，电影类型,以及所提供的过滤器（包含页面页码等信息），返回所有movies的列表（其中存放各个movie结构体的地址
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetAll")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetAll")()
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, version, change_seq
 				FROM movies
-				WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+				WHERE deleted_at IS NULL
+				AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 				AND (genres @> $2 OR $2 = '{}')
-				ORDER BY %s %s, id ASC
-				LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+				ORDER BY %s
+				LIMIT $3 OFFSET $4`, filters.orderBy("id"))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.Offset()}
 
 	// Use the QueryContext() to execute the query.This returns a sql.Rows resultset
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := reader(ctx, m.DB, m.ReadDB).QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -195,11 +503,13 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.ChangeSeq,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -219,19 +529,290 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
+// GetSimilar 返回与指定movie有相同类型的其他movie，共同类型越多越靠前，没有匹配时返回空切片
+func (m MovieModel) GetSimilar(ctx context.Context, id int64, limit int) ([]*Movie, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetSimilar")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetSimilar")()
+
+	query := `
+			SELECT m.id, m.created_at, m.updated_at, m.title, m.year, m.runtime, m.genres, m.version, m.change_seq
+			FROM movies m
+			INNER JOIN movies t ON t.id = $1 AND t.deleted_at IS NULL
+			WHERE m.id <> t.id
+			AND m.deleted_at IS NULL
+			AND m.genres && t.genres
+			ORDER BY cardinality(ARRAY(SELECT unnest(m.genres) INTERSECT SELECT unnest(t.genres))) DESC, m.id ASC
+			LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.ChangeSeq,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// GetGenres 返回所有movie中出现过的类型以及使用次数，按次数降序排列
+func (m MovieModel) GetGenres(ctx context.Context) ([]GenreCount, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetGenres")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetGenres")()
+
+	query := `
+			SELECT genre, count(*)
+			FROM movies, unnest(genres) AS genre
+			WHERE deleted_at IS NULL
+			GROUP BY genre
+			ORDER BY count(*) DESC, genre ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []GenreCount{}
+
+	for rows.Next() {
+		var gc GenreCount
+
+		err := rows.Scan(&gc.Genre, &gc.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, gc)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// GetGenreCounts 返回指定的每个类型被多少部movie使用，没有被使用的类型计数为0
+func (m MovieModel) GetGenreCounts(ctx context.Context, genres []string) (map[string]int, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetGenreCounts")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetGenreCounts")()
+
+	query := `
+			SELECT genre, count(*)
+			FROM movies, unnest(genres) AS genre
+			WHERE deleted_at IS NULL
+			AND genre = ANY($1)
+			GROUP BY genre`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := reader(ctx, m.DB, m.ReadDB).QueryContext(ctx, query, pq.Array(genres))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(genres))
+	for _, genre := range genres {
+		counts[genre] = 0
+	}
+
+	for rows.Next() {
+		var genre string
+		var count int
+
+		err := rows.Scan(&genre, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[genre] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// GetChanges 按change_seq升序返回since之后发生变化的最多limit条记录。
+// 仍然存在的movie放在movies中，被软删除的只返回id；highWater是这批记录中最大的change_seq，
+// 没有变化时等于since，客户端下次同步时将其作为since传回。
+// change_seq在语句执行时分配。写movies的语句通过触发器持有共享的advisory lock直到事务结束(迁移000020)，
+// 这里先获取排他锁，等待所有已经分配了change_seq的事务结束之后再读取，
+// 所以读到的change_seq之前不会再有更小的值提交，highWater可以安全地交给客户端。写入之间不会互相阻塞
+func (m MovieModel) GetChanges(ctx context.Context, since int64, limit int) ([]*Movie, []int64, int64, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetChanges")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetChanges")()
+
+	query := `
+			SELECT id, created_at, updated_at, title, year, runtime, genres, version, change_seq, deleted_at IS NOT NULL
+			FROM movies
+			WHERE change_seq > $1
+			ORDER BY change_seq ASC
+			LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	movies := []*Movie{}
+	deleted := []int64{}
+	highWater := since
+
+	// 锁和查询是同一个事务中的两条语句，READ COMMITTED下查询使用获取锁之后的快照
+	err := inTx(ctx, m.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('movies_change_seq'))")
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, query, since, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var movie Movie
+			var isDeleted bool
+
+			err := rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.UpdatedAt,
+				&movie.Title,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				&movie.Version,
+				&movie.ChangeSeq,
+				&isDeleted,
+			)
+			if err != nil {
+				return err
+			}
+
+			if isDeleted {
+				deleted = append(deleted, movie.ID)
+			} else {
+				movies = append(movies, &movie)
+			}
+
+			highWater = movie.ChangeSeq
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return movies, deleted, highWater, nil
+}
+
+// MovieRules 是ValidateMovie中可以通过启动参数调整的规则
+type MovieRules struct {
+	// title的最大字节数，movies表中的title是text类型，数据库本身没有长度限制
+	MaxTitleLength int
+	MinGenres      int
+	MaxGenres      int
+	// 每个类型的最大字节数，类型是任意文本，不限制的话单个类型可以占满整个请求体
+	MaxGenreLength int
+	// 允许使用的类型，为nil时类型可以是任意文本
+	AllowedGenres []string
+}
+
+// DefaultMovieRules 与最初写死的规则一致：title最多500字节，1到5个类型，不限制类型名称。每个类型最多50字节
+var DefaultMovieRules = MovieRules{MaxTitleLength: 500, MinGenres: 1, MaxGenres: 5, MaxGenreLength: 50}
+
+// 检查启动参数中的规则是否合理，数据库要求每部电影至少有一个类型
+func (r MovieRules) Validate() error {
+	if r.MaxTitleLength < 1 {
+		return fmt.Errorf("maximum title length must be at least 1, got %d", r.MaxTitleLength)
+	}
+	if r.MinGenres < 1 {
+		return fmt.Errorf("minimum genre count must be at least 1, got %d", r.MinGenres)
+	}
+	if r.MaxGenres < r.MinGenres {
+		return fmt.Errorf("maximum genre count (%d) must not be less than the minimum (%d)", r.MaxGenres, r.MinGenres)
+	}
+	if r.MaxGenreLength < 1 {
+		return fmt.Errorf("maximum genre length must be at least 1, got %d", r.MaxGenreLength)
+	}
+	return nil
+}
+
+// PluralGenres 返回"1 genre"或"n genres"，用于错误信息
+func PluralGenres(n int) string {
+	if n == 1 {
+		return "1 genre"
+	}
+	return fmt.Sprintf("%d genres", n)
+}
+
 // ValidateMovie 检验传来的movie对象是否能通过校验器中的检验方法
-func ValidateMovie(v *validator.Validator, movie *Movie) {
+func ValidateMovie(v *validator.Validator, movie *Movie, rules MovieRules) {
 	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(movie.Title) <= rules.MaxTitleLength, "title", fmt.Sprintf("must not be more than %d bytes long", rules.MaxTitleLength))
 	v.Check(movie.Year != 0, "year", "must be provided")
 	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.Check(movie.Runtime > 0, "runtime", "must be a positive duration")
 	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(len(movie.Genres) >= rules.MinGenres, "genres", "must contain at least "+PluralGenres(rules.MinGenres))
+	v.Check(len(movie.Genres) <= rules.MaxGenres, "genres", "must not contain more than "+PluralGenres(rules.MaxGenres))
 	// Note that we're using the Unique helper in the line below to check that all
 	// values in the movie.Genres slice are unique.
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	for _, genre := range movie.Genres {
+		if len(genre) > rules.MaxGenreLength {
+			v.AddError("genres", fmt.Sprintf("must not contain genres more than %d bytes long", rules.MaxGenreLength))
+			break
+		}
+	}
+
+	// 开启类型限制时列出所有不被允许的类型
+	if invalid := InvalidGenres(movie.Genres, rules.AllowedGenres); len(invalid) > 0 {
+		v.AddError("genres", "contains genres that are not allowed: "+strings.Join(invalid, ", "))
+	}
 }
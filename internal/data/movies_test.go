@@ -0,0 +1,256 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// 大量year相同的movie在按year分页时，每一部都应该恰好出现一次
+func TestGetAllPaginationIsStable(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	// 使用唯一的标题前缀，只分页这次测试插入的记录
+	marker := fmt.Sprintf("paginationtest%d", time.Now().UnixNano())
+	const total = 25
+
+	inserted := make(map[int64]bool, total)
+
+	for i := 0; i < total; i++ {
+		movie := &Movie{
+			Title:   fmt.Sprintf("%s movie %d", marker, i),
+			Year:    2000,
+			Runtime: Runtime(100 * 60),
+			Genres:  []string{"drama"},
+		}
+
+		err := models.Movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserted[movie.ID] = true
+	}
+	t.Cleanup(func() {
+		for id := range inserted {
+			db.Exec("DELETE FROM movies WHERE id = $1", id)
+		}
+	})
+
+	for _, sort := range []string{"year", "-year", "runtime", "-runtime"} {
+		t.Run(sort, func(t *testing.T) {
+			seen := make(map[int64]int)
+
+			filters := NewFilters(sort, MovieSortSafelist...)
+			filters.PageSize = 4
+
+			for {
+				movies, metadata, err := models.Movies.GetAll(ctx, marker, []string{}, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, movie := range movies {
+					seen[movie.ID]++
+				}
+
+				if filters.Page >= metadata.LastPage {
+					break
+				}
+				filters.Page++
+			}
+
+			if len(seen) != total {
+				t.Errorf("got %d distinct movies; want %d", len(seen), total)
+			}
+			for id, count := range seen {
+				if !inserted[id] {
+					t.Errorf("unexpected movie %d in results", id)
+				}
+				if count != 1 {
+					t.Errorf("movie %d returned %d times; want 1", id, count)
+				}
+			}
+		})
+	}
+}
+
+// 超过MaxGenres的写入在访问数据库之前就被拒绝，不需要测试数据库
+func TestMovieWriteRejectsTooManyGenres(t *testing.T) {
+	models := NewModels(nil, ModelOptions{MaxGenres: 2})
+	movie := &Movie{ID: 1, Title: "Moana", Genres: []string{"animation", "adventure", "comedy"}, Version: 1}
+
+	err := models.Movies.Insert(context.Background(), movie)
+	if !errors.Is(err, ErrTooManyGenres) {
+		t.Errorf("Insert: got error %v; want %v", err, ErrTooManyGenres)
+	}
+
+	err = models.Movies.Update(context.Background(), movie, 0)
+	if !errors.Is(err, ErrTooManyGenres) {
+		t.Errorf("Update: got error %v; want %v", err, ErrTooManyGenres)
+	}
+
+	movie.Genres = []string{"animation", "adventure"}
+	err = models.Movies.AddGenre(context.Background(), movie, "comedy", 0)
+	if !errors.Is(err, ErrTooManyGenres) {
+		t.Errorf("AddGenre: got error %v; want %v", err, ErrTooManyGenres)
+	}
+	if len(movie.Genres) != 2 {
+		t.Errorf("AddGenre modified movie.Genres: %v", movie.Genres)
+	}
+}
+
+// 请求体上限之内的超长类型同样应该被拒绝，错误记录在genres上
+func TestValidateMovieRejectsLongGenre(t *testing.T) {
+	tests := []struct {
+		name  string
+		genre string
+		valid bool
+	}{
+		{name: "at limit", genre: strings.Repeat("a", DefaultMovieRules.MaxGenreLength), valid: true},
+		{name: "over limit", genre: strings.Repeat("a", DefaultMovieRules.MaxGenreLength+1)},
+		{name: "pathological", genre: strings.Repeat("a", 1<<20-100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := &Movie{Title: "Moana", Year: 2016, Runtime: Runtime(107 * 60), Genres: []string{"animation", tt.genre}}
+
+			v := validator.New()
+			ValidateMovie(v, movie, DefaultMovieRules)
+
+			if v.Valid() != tt.valid {
+				t.Fatalf("got valid %t; want %t (errors %v)", v.Valid(), tt.valid, v.Errors)
+			}
+			if !tt.valid && v.Errors["genres"] == "" {
+				t.Errorf("got errors %v; want an error on genres", v.Errors)
+			}
+		})
+	}
+}
+
+func TestMovieRestore(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	movie := &Movie{Title: fmt.Sprintf("restoretest%d", time.Now().UnixNano()), Year: 2000, Runtime: Runtime(100 * 60), Genres: []string{"drama"}}
+	err := models.Movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM movies WHERE id = $1", movie.ID)
+	})
+
+	_, err = models.Movies.Restore(ctx, movie.ID)
+	if !errors.Is(err, ErrMovieNotDeleted) {
+		t.Fatalf("restoring a live movie: got error %v; want %v", err, ErrMovieNotDeleted)
+	}
+
+	err = models.Movies.Delete(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := models.Movies.Restore(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != movie.Title || restored.ChangeSeq <= movie.ChangeSeq {
+		t.Errorf("got restored movie %+v; want title %q and a newer change_seq than %d", restored, movie.Title, movie.ChangeSeq)
+	}
+
+	_, err = models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Errorf("getting the restored movie: %v", err)
+	}
+
+	_, err = models.Movies.Restore(ctx, 1<<62)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("restoring a missing movie: got error %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+// 先分配change_seq的事务还没有提交时，后面的写入不受影响，但GetChanges需要等待它结束，
+// 增量同步不会跳过提交较晚但change_seq较小的修改
+func TestGetChangesFollowsCommitOrder(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	var movies []*Movie
+	for i := 0; i < 2; i++ {
+		movie := &Movie{Title: fmt.Sprintf("changetest%d-%d", time.Now().UnixNano(), i), Year: 2000, Runtime: Runtime(100 * 60), Genres: []string{"drama"}}
+		err := models.Movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Exec("DELETE FROM movies WHERE id = $1", movie.ID)
+		})
+		movies = append(movies, movie)
+	}
+	since := movies[1].ChangeSeq
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE movies SET change_seq = nextval('movies_change_seq') WHERE id = $1", movies[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入之间不会互相阻塞
+	err = models.Movies.Update(ctx, movies[1], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		changed []*Movie
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		changed, _, _, err := models.Movies.GetChanges(ctx, since, 1000)
+		done <- result{changed, err}
+	}()
+
+	// 较小的change_seq还没有提交，GetChanges需要等待
+	select {
+	case res := <-done:
+		t.Fatalf("GetChanges returned while an earlier change was uncommitted (err %v)", res.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	changed := res.changed
+
+	var order []int64
+	for _, movie := range changed {
+		if movie.ID == movies[0].ID || movie.ID == movies[1].ID {
+			order = append(order, movie.ID)
+		}
+	}
+	if len(order) != 2 || order[0] != movies[0].ID {
+		t.Errorf("got changes for movies %v; want %d before %d", order, movies[0].ID, movies[1].ID)
+	}
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MovieVersion 是movie被修改之前的一个版本，ChangedAt和ChangedBy表示这个版本何时被谁替换
+type MovieVersion struct {
+	Version   int32     `json:"version"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year,omitempty"`
+	Runtime   Runtime   `json:"runtime,omitempty"`
+	Genres    []string  `json:"genres,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+	ChangedBy *int64    `json:"changed_by,omitempty"` // 修改人的用户id，未知或者用户已被删除时为nil
+}
+
+// MovieVersionSortSafelist 修改历史固定按版本倒序排列
+var MovieVersionSortSafelist = []string{"-version"}
+
+// 将movie表中指定version的记录复制到movie_versions，version已经变化时返回ErrEditConflict
+func saveMovieVersion(ctx context.Context, tx *sql.Tx, id int64, version int32, changedBy int64) error {
+	query := `
+			INSERT INTO movie_versions (movie_id, version, title, year, runtime, genres, changed_by)
+			SELECT id, version, title, year, runtime, genres, $3
+			FROM movies
+			WHERE id = $1 AND version = $2 AND deleted_at IS NULL`
+
+	result, err := tx.ExecContext(ctx, query, id, version, sql.NullInt64{Int64: changedBy, Valid: changedBy > 0})
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// GetVersions 返回movie的修改历史，最新的版本在前
+func (m MovieModel) GetVersions(ctx context.Context, id int64, filters Filters) ([]*MovieVersion, Metadata, error) {
+	ctx, span := m.Tracer.Start(ctx, "movies.GetVersions")
+	defer span.End()
+	defer m.SlowQueries.track("movies.GetVersions")()
+
+	query := `
+			SELECT count(*) OVER(), version, title, year, runtime, genres, changed_at, changed_by
+			FROM movie_versions
+			WHERE movie_id = $1
+			ORDER BY version DESC, id DESC
+			LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, filters.limit(), filters.Offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	versions := []*MovieVersion{}
+
+	for rows.Next() {
+		var v MovieVersion
+
+		err := rows.Scan(
+			&totalRecords,
+			&v.Version,
+			&v.Title,
+			&v.Year,
+			&v.Runtime,
+			pq.Array(&v.Genres),
+			&v.ChangedAt,
+			&v.ChangedBy,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		versions = append(versions, &v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return versions, metadata, nil
+}
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// 嵌入的常见密码列表，每行一个，#开头的行是注释
+//
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = loadCommonPasswords(commonPasswordsFile)
+
+func loadCommonPasswords(file string) map[string]bool {
+	passwords := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = true
+	}
+
+	return passwords
+}
+
+// PasswordPolicy 是注册和修改密码时使用的密码强度规则。bcrypt只使用前72个字节，所以最大长度固定为72
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	RejectCommon     bool
+}
+
+// DefaultPasswordPolicy 只检查长度，登录时也使用它，避免收紧规则之后已有的用户无法登录
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+// 检查启动参数中的策略是否合理
+func (p PasswordPolicy) Validate() error {
+	if p.MinLength < 1 || p.MinLength > 72 {
+		return fmt.Errorf("password minimum length must be between 1 and 72, got %d", p.MinLength)
+	}
+	return nil
+}
+
+// 根据策略检查密码，每条规则使用单独的错误信息
+func (p PasswordPolicy) check(v *validator.Validator, password string) {
+	v.Check(len(password) >= p.MinLength, "password", fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireMixedCase {
+		v.Check(upper && lower, "password", "must contain both upper and lower case letters")
+	}
+	if p.RequireDigit {
+		v.Check(digit, "password", "must contain at least one digit")
+	}
+	if p.RequireSymbol {
+		v.Check(symbol, "password", "must contain at least one symbol")
+	}
+	if p.RejectCommon {
+		v.Check(!commonPasswords[strings.ToLower(password)], "password", "is too common")
+	}
+}
@@ -2,11 +2,26 @@ package data
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
+// PermissionCodes 是代码中用到的全部权限，启动时通过EnsureCodes保证它们都存在于permissions表中，
+// 否则AddForUser会因为找不到对应的行而静默地什么也不做。新增权限时需要同时加到这里
+var PermissionCodes = []string{
+	"movies:read",
+	"movies:write",
+	"movies:delete",
+	"movies:admin",
+	"emails:read",
+	"stats:read",
+	"users:read",
+	"users:write",
+	"ratelimit:exempt",
+}
+
 // 定义一个权限切片来保存获取到的权限
 type Permissions []string
 
@@ -21,19 +36,27 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
 }
 
 // 通过某个具体的userID得到其所有权限
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := m.Tracer.Start(ctx, "permissions.GetAllForUser")
+	defer span.End()
+	defer m.SlowQueries.track("permissions.GetAllForUser")()
+
 	query := `
 			SELECT permissions.code
 			FROM permissions
-			INNER JOIN users_permissions ON users_permission.permission_id=permissions.id
+			INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 			INNER JOIN users ON users_permissions.user_id = users.id
 			WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -61,15 +84,122 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// GetAllForUsers 用一次查询获取多个用户的权限，按用户id分组，避免列出用户时逐个查询。
+// 没有任何权限的用户不会出现在map中，直接按id取值得到的nil Permissions同样可以调用Include
+func (m PermissionModel) GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error) {
+	ctx, span := m.Tracer.Start(ctx, "permissions.GetAllForUsers")
+	defer span.End()
+	defer m.SlowQueries.track("permissions.GetAllForUsers")()
+
+	query := `
+			SELECT users_permissions.user_id, permissions.code
+			FROM permissions
+			INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+			WHERE users_permissions.user_id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[int64]Permissions)
+
+	for rows.Next() {
+		var userID int64
+		var permission string
+
+		err := rows.Scan(&userID, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions[userID] = append(permissions[userID], permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 // 为某个具体userID添加指定的权限
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := m.Tracer.Start(ctx, "permissions.AddForUser")
+	defer span.End()
+	defer m.SlowQueries.track("permissions.AddForUser")()
+
 	query := `
 			INSERT INTO users_permissions
 			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// EnsureCodes 插入permissions表中还不存在的权限，返回新插入的权限
+func (m PermissionModel) EnsureCodes(ctx context.Context, codes ...string) ([]string, error) {
+	ctx, span := m.Tracer.Start(ctx, "permissions.EnsureCodes")
+	defer span.End()
+	defer m.SlowQueries.track("permissions.EnsureCodes")()
+
+	// 多个实例同时启动时依靠permissions.code上的唯一索引避免插入重复的权限，已经存在的code不会被返回
+	query := `
+			INSERT INTO permissions (code)
+			SELECT c.code FROM unnest($1::text[]) AS c(code)
+			ON CONFLICT (code) DO NOTHING
+			RETURNING code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	inserted, err := m.insertCodes(ctx, query, codes)
+
+	// 唯一索引由迁移000021创建，先部署新版本再执行迁移时还没有这个索引(42P10)，
+	// 退回到之前的写法，避免服务器无法启动
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P10" {
+		query = `
+			INSERT INTO permissions (code)
+			SELECT c.code FROM unnest($1::text[]) AS c(code)
+			WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = c.code)
+			RETURNING code`
+
+		inserted, err = m.insertCodes(ctx, query, codes)
+	}
+
+	return inserted, err
+}
+
+// 执行EnsureCodes的插入语句，返回新插入的code
+func (m PermissionModel) insertCodes(ctx context.Context, query string, codes []string) ([]string, error) {
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inserted []string
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		inserted = append(inserted, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return inserted, nil
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 集成测试使用的数据库需要已经执行过全部迁移，没有设置GREENLIGHT_TEST_DB_DSN时跳过
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.PingContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestPermissionsGrantAndRead(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	_, err := models.Permissions.EnsureCodes(ctx, PermissionCodes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{
+		Name:  "Permissions Test",
+		Email: fmt.Sprintf("permissions-%d@example.com", time.Now().UnixNano()),
+	}
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// users_permissions中的记录随用户级联删除
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", user.ID) })
+
+	err = models.Permissions.AddForUser(ctx, user.ID, "movies:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !permissions.Include("movies:read") {
+		t.Errorf("got permissions %v; want movies:read", permissions)
+	}
+	if permissions.Include("movies:write") {
+		t.Errorf("got permissions %v; movies:write was not granted", permissions)
+	}
+}
+
+// 并发调用EnsureCodes时每个code只会被插入一次
+func TestEnsureCodesConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	code := fmt.Sprintf("test:%d", time.Now().UnixNano())
+	t.Cleanup(func() { db.Exec("DELETE FROM permissions WHERE code = $1", code) })
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inserted := 0
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			codes, err := models.Permissions.EnsureCodes(context.Background(), code)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			inserted += len(codes)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM permissions WHERE code = $1", code).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 || inserted != 1 {
+		t.Errorf("got %d rows and %d reported inserts; want 1 of each", count, inserted)
+	}
+}
+
+// fakeNoUniqueDriver 模拟还没有执行迁移000021的数据库：ON CONFLICT (code)返回42P10，其他语句与fakeStmtDriver相同
+type fakeNoUniqueDriver struct{}
+
+func (fakeNoUniqueDriver) Open(name string) (driver.Conn, error) {
+	return fakeNoUniqueConn{&fakeStmtConn{}}, nil
+}
+
+type fakeNoUniqueConn struct {
+	*fakeStmtConn
+}
+
+func (fakeNoUniqueConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(query, "ON CONFLICT (code)") {
+		return nil, &pq.Error{Code: "42P10", Message: "there is no unique or exclusion constraint matching the ON CONFLICT specification"}
+	}
+	return fakeStmt{}, nil
+}
+
+var registerFakeNoUniqueDriver sync.Once
+
+// 没有唯一索引时EnsureCodes退回到WHERE NOT EXISTS，服务器仍然可以在迁移之前启动
+func TestEnsureCodesWithoutUniqueIndex(t *testing.T) {
+	registerFakeNoUniqueDriver.Do(func() {
+		sql.Register("fakenounique", fakeNoUniqueDriver{})
+	})
+
+	db, err := sql.Open("fakenounique", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	inserted, err := NewModels(db, ModelOptions{}).Permissions.EnsureCodes(context.Background(), "movies:read")
+	if err != nil {
+		t.Fatalf("got error %v; want the fallback query to succeed", err)
+	}
+	if len(inserted) != 1 {
+		t.Errorf("got inserted %v; want one code", inserted)
+	}
+}
@@ -0,0 +1,58 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// RegisterUser 在同一个事务中插入用户、授予权限、生成激活令牌并把welcome返回的邮件加入发件队列，
+// 任何一步失败都不会留下不完整的用户，也不会留下收不到激活邮件的用户。welcome为nil时不发送邮件。
+// email重复时返回ErrDuplicateEmail
+func (m Models) RegisterUser(ctx context.Context, user *User, activationTTL time.Duration, welcome func(token *Token) *Email, codes ...string) (*Token, error) {
+	ctx, span := m.tracer.Start(ctx, "users.Register")
+	defer span.End()
+
+	var token *Token
+
+	err := m.WithTx(ctx, func(tx Models) error {
+		err := tx.Users.Insert(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.AddForUser(ctx, user.ID, codes...)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(ctx, user.ID, activationTTL, ScopeActivation)
+		if err != nil || welcome == nil {
+			return err
+		}
+
+		return tx.Emails.Insert(ctx, welcome(token))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// ActivateUser 由管理员手动激活用户，在同一个事务中保存用户并删除所有未使用的激活令牌。
+// 不修改verified_at，邮箱仍然视为没有验证过。版本不一致时返回ErrEditConflict
+func (m Models) ActivateUser(ctx context.Context, user *User) error {
+	ctx, span := m.tracer.Start(ctx, "users.Activate")
+	defer span.End()
+
+	user.Activated = true
+
+	return m.WithTx(ctx, func(tx Models) error {
+		err := tx.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(ctx, ScopeActivation, user.ID)
+	})
+}
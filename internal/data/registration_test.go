@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestActivateUserDeletesActivationTokens(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	user := &User{
+		Name:  "Activation Test",
+		Email: fmt.Sprintf("activation-%d@example.com", time.Now().UnixNano()),
+	}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := models.RegisterUser(ctx, user, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tokens中的记录随用户级联删除
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", user.ID) })
+
+	err = models.ActivateUser(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.Users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Activated {
+		t.Error("user was not activated")
+	}
+	if got.VerifiedAt != nil {
+		t.Errorf("got verified_at %v; want nil", got.VerifiedAt)
+	}
+
+	_, err = models.Users.GetForToken(ctx, ScopeActivation, token.Plaintext)
+	if err != ErrRecordNotFound {
+		t.Errorf("got error %v for the old activation token; want ErrRecordNotFound", err)
+	}
+}
+
+// 欢迎邮件在注册的事务中加入队列，加入失败时用户和令牌一起回滚
+func TestRegisterUserEnqueuesWelcomeEmail(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, ModelOptions{})
+	ctx := context.Background()
+
+	newUser := func() *User {
+		user := &User{
+			Name:  "Registration Test",
+			Email: fmt.Sprintf("registration-%d@example.com", time.Now().UnixNano()),
+		}
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	user := newUser()
+	_, err := models.RegisterUser(ctx, user, time.Hour, func(token *Token) *Email {
+		return &Email{Recipient: user.Email, Template: "user_welcome.tmpl", Data: map[string]interface{}{"activationToken": token.Plaintext}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM emails WHERE recipient = $1", user.Email)
+		db.Exec("DELETE FROM users WHERE id = $1", user.ID)
+	})
+
+	var queued int
+	err = db.QueryRow("SELECT count(*) FROM emails WHERE recipient = $1", user.Email).Scan(&queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("got %d queued emails; want 1", queued)
+	}
+
+	// 模版数据无法序列化时Insert失败
+	failed := newUser()
+	_, err = models.RegisterUser(ctx, failed, time.Hour, func(token *Token) *Email {
+		return &Email{Recipient: failed.Email, Template: "user_welcome.tmpl", Data: map[string]interface{}{"bad": make(chan int)}}
+	})
+	if err == nil {
+		t.Fatal("expected an error when the email cannot be queued")
+	}
+
+	_, err = models.Users.GetByEmail(ctx, failed.Email)
+	if err != ErrRecordNotFound {
+		t.Errorf("got error %v for the rolled back user; want ErrRecordNotFound", err)
+	}
+}
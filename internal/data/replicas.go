@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+)
+
+// ReplicaSet 是只读副本的连接池集合，每次查询依次轮流使用其中一个。
+// 只用于读取：副本上的数据可能稍有延迟，需要读到刚写入数据的地方仍然应该使用主库
+type ReplicaSet struct {
+	dbs  []DBTX
+	next atomic.Uint64
+}
+
+// NewReplicaSet 至少需要一个连接池
+func NewReplicaSet(dbs ...DBTX) *ReplicaSet {
+	if len(dbs) == 0 {
+		panic("data: NewReplicaSet requires at least one database")
+	}
+	return &ReplicaSet{dbs: dbs}
+}
+
+func (r *ReplicaSet) pick() DBTX {
+	return r.dbs[(r.next.Add(1)-1)%uint64(len(r.dbs))]
+}
+
+func (r *ReplicaSet) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return r.pick().ExecContext(ctx, query, args...)
+}
+
+func (r *ReplicaSet) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return r.pick().QueryContext(ctx, query, args...)
+}
+
+func (r *ReplicaSet) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return r.pick().QueryRowContext(ctx, query, args...)
+}
+
+type primaryContextKey struct{}
+
+// WithPrimary 返回的ctx中的读取都使用主库。结果会被写入缓存时使用，避免把副本上落后的数据缓存起来
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// 读取使用的连接，没有配置副本，在事务中或者ctx要求读取主库时为DB本身
+func reader(ctx context.Context, db, readDB DBTX) DBTX {
+	if readDB != nil && ctx.Value(primaryContextKey{}) == nil {
+		return readDB
+	}
+	return db
+}
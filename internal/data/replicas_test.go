@@ -0,0 +1,69 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestReplicaSetRoundRobin(t *testing.T) {
+	var dbs []DBTX
+	for i := 0; i < 3; i++ {
+		// sql.Open不会建立连接
+		db, err := sql.Open("postgres", "postgres://localhost/replica")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+
+	replicas := NewReplicaSet(dbs...)
+
+	for i := 0; i < 6; i++ {
+		if got := replicas.pick(); got != dbs[i%3] {
+			t.Errorf("pick %d: got replica %p; want %p", i, got, dbs[i%3])
+		}
+	}
+}
+
+func TestModelsWithoutReplicasReadFromPrimary(t *testing.T) {
+	db, err := sql.Open("postgres", "postgres://localhost/primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	models := NewModels(db, ModelOptions{})
+
+	movies := models.Movies.(MovieModel)
+	if movies.ReadDB != nil {
+		t.Fatalf("got ReadDB %v; want nil", movies.ReadDB)
+	}
+	if reader(context.Background(), movies.DB, movies.ReadDB) != DBTX(db) {
+		t.Error("reads without replicas should use the primary")
+	}
+
+	replica, err := sql.Open("postgres", "postgres://localhost/replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	models = NewModels(db, ModelOptions{Replicas: []*sql.DB{replica}})
+
+	// WithPrimary要求的读取不使用副本
+	movies = models.Movies.(MovieModel)
+	if reader(context.Background(), movies.DB, movies.ReadDB) == movies.DB {
+		t.Error("reads with replicas should use a replica")
+	}
+	if reader(WithPrimary(context.Background()), movies.DB, movies.ReadDB) != movies.DB {
+		t.Error("reads with WithPrimary should use the primary")
+	}
+
+	// 事务中的读取不能使用副本
+	users := models.withDB(&sql.Tx{}).Users.(UserModel)
+	if users.ReadDB != nil {
+		t.Errorf("got ReadDB %v inside a transaction; want nil", users.ReadDB)
+	}
+}
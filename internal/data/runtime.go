@@ -3,6 +3,8 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -10,44 +12,121 @@ import (
 // ErrInvalidRuntimeFormat 是一个UnmarshalJSON方法会发生的错误类型
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 
-// Runtime 本质上还是int32类型的，序列化为JSON时转为string类型，反序列化为Go时转回int32类型
+// Runtime 本质上还是int32类型的，保存电影时长的总秒数。序列化为JSON时转为string类型，反序列化为Go时转回int32类型
 type Runtime int32
 
+// Runtime序列化为JSON时使用的格式
+const (
+	// "134 mins"，不是整分钟时使用RuntimeFormatHMS的格式，避免丢失秒数
+	RuntimeFormatMins = "mins"
+	// "2h 14m 30s"，为0的部分省略
+	RuntimeFormatHMS = "hms"
+)
+
+// RuntimeFormat 是MarshalJSON使用的格式，启动时根据-runtime-format设置，默认与之前一样输出"<n> mins"
+var RuntimeFormat = RuntimeFormatMins
+
+// "2h 14m 30s"格式，各部分都可以省略但至少要有一个，空格可有可无
+var rxRuntimeHMS = regexp.MustCompile(`^(?:(\d+)h)? ?(?:(\d+)m)? ?(?:(\d+)s)?$`)
+
+// ErrRuntimeOutOfRange 表示换算成秒之后超出了int32的范围
+var ErrRuntimeOutOfRange = errors.New("runtime out of range")
+
+// RuntimeFromMinutes 将分钟数转换为Runtime，用于仍然以分钟为单位的接口(gRPC，GraphQL)。
+// 在int64中计算，超出int32范围时返回ErrRuntimeOutOfRange，而不是溢出成一个看起来正常的值
+func RuntimeFromMinutes(minutes int32) (Runtime, error) {
+	seconds := int64(minutes) * 60
+	if seconds > math.MaxInt32 || seconds < math.MinInt32 {
+		return 0, ErrRuntimeOutOfRange
+	}
+
+	return Runtime(seconds), nil
+}
+
+// Minutes 返回四舍五入后的分钟数
+func (r Runtime) Minutes() int32 {
+	return int32(math.Round(float64(r) / 60))
+}
+
+// String 按照RuntimeFormat返回时长
+func (r Runtime) String() string {
+	if RuntimeFormat == RuntimeFormatMins && r%60 == 0 {
+		return fmt.Sprintf("%d mins", r/60)
+	}
+
+	if r == 0 {
+		return "0s"
+	}
+
+	var parts []string
+	if h := r / 3600; h != 0 {
+		parts = append(parts, fmt.Sprintf("%dh", h))
+	}
+	if m := r % 3600 / 60; m != 0 {
+		parts = append(parts, fmt.Sprintf("%dm", m))
+	}
+	if s := r % 60; s != 0 {
+		parts = append(parts, fmt.Sprintf("%ds", s))
+	}
+
+	return strings.Join(parts, " ")
+}
+
 // MarshalJSON 为Runtime类型实现接口（重写该方法）实现了自定义JSON序列化格式
 func (r Runtime) MarshalJSON() ([]byte, error) {
-	// 产生一个string显示我们要的电影时长格式
-	jsonValue := fmt.Sprintf("%d mins", r)
-
 	// 使用strconv.Quote()函数将string包裹在双引号中，以符合JSON string的格式
-	quotedJSONValue := strconv.Quote(jsonValue)
-
-	// 将这样一个string转为字节切片返回
-	return []byte(quotedJSONValue), nil
+	return []byte(strconv.Quote(r.String())), nil
 }
 
-// UnmarshalJSON 为Runtime类型实现反序列化接口，自定义使传来的string类型反序列化为Runtime(int32)类型
+// UnmarshalJSON 为Runtime类型实现反序列化接口，与输出格式无关，两种格式都可以接受：
+// "<n> mins"(n可以是小数，四舍五入到秒)以及"2h 14m 30s"
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// 传来的电影时长runtime应该是"<runtime> mins"这样的格式，先试着去除双引号
+	// 先试着去除双引号
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
 
-	// 如果没有错误，就提取number部分
-	parts := strings.Split(unquotedJSONValue, " ")
+	seconds, err := parseRuntime(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
 
-	if len(parts) != 2 || parts[1] != "mins" {
-		return ErrInvalidRuntimeFormat
+	*r = Runtime(seconds)
+
+	return nil
+}
+
+// 解析时长，返回总秒数
+func parseRuntime(s string) (int64, error) {
+	if minutes, ok := strings.CutSuffix(s, " mins"); ok {
+		f, err := strconv.ParseFloat(minutes, 64)
+		if err != nil || math.IsNaN(f) || math.Abs(f*60) > math.MaxInt32 {
+			return 0, ErrInvalidRuntimeFormat
+		}
+		return int64(math.Round(f * 60)), nil
 	}
 
-	// 否则，进行转换为int类型
-	i, err := strconv.ParseInt(parts[0], 10, 32)
-	if err != nil {
-		return ErrInvalidRuntimeFormat
+	matches := rxRuntimeHMS.FindStringSubmatch(s)
+	if matches == nil || strings.TrimSpace(s) == "" || strings.TrimSpace(s) != s {
+		return 0, ErrInvalidRuntimeFormat
 	}
 
-	// Convert the int32 to a Runtime type(本质上也是int32)
-	*r = Runtime(i)
+	var seconds int64
+	for i, unit := range []int64{3600, 60, 1} {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(matches[i+1], 10, 32)
+		if err != nil {
+			return 0, ErrInvalidRuntimeFormat
+		}
+		seconds += n * unit
+	}
 
-	return nil
+	if seconds > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	return seconds, nil
 }
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Runtime
+		wantErr bool
+	}{
+		{input: `"134 mins"`, want: 134 * 60},
+		{input: `"134.5 mins"`, want: 134*60 + 30},
+		{input: `"2h 14m 30s"`, want: 2*3600 + 14*60 + 30},
+		{input: `"2h14m"`, want: 2*3600 + 14*60},
+		{input: `"90s"`, want: 90},
+		{input: `"134"`, wantErr: true},
+		{input: `"134 minutes"`, wantErr: true},
+		{input: `""`, wantErr: true},
+		{input: `"2h 14m "`, wantErr: true},
+		{input: `134`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var r Runtime
+			err := r.UnmarshalJSON([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && r != tt.want {
+				t.Errorf("got %d seconds; want %d", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeMarshalJSON(t *testing.T) {
+	defer func(format string) { RuntimeFormat = format }(RuntimeFormat)
+
+	tests := []struct {
+		format  string
+		runtime Runtime
+		want    string
+	}{
+		{format: RuntimeFormatMins, runtime: 134 * 60, want: `"134 mins"`},
+		// 不是整分钟时不能用mins格式表示
+		{format: RuntimeFormatMins, runtime: 134*60 + 30, want: `"2h 14m 30s"`},
+		{format: RuntimeFormatHMS, runtime: 134 * 60, want: `"2h 14m"`},
+		{format: RuntimeFormatHMS, runtime: 45, want: `"45s"`},
+	}
+
+	for _, tt := range tests {
+		RuntimeFormat = tt.format
+
+		got, err := tt.runtime.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("format %s: got %s; want %s", tt.format, got, tt.want)
+		}
+	}
+}
+
+// 换算成秒在int64中进行，超出int32范围的分钟数不会溢出成一个看起来正常的值
+func TestRuntimeFromMinutes(t *testing.T) {
+	tests := []struct {
+		minutes int32
+		want    Runtime
+		wantErr error
+	}{
+		{minutes: 107, want: 107 * 60},
+		{minutes: 35791394, want: 35791394 * 60},
+		{minutes: 35791395, wantErr: ErrRuntimeOutOfRange},
+		{minutes: 71582789, wantErr: ErrRuntimeOutOfRange},
+		{minutes: -35791395, wantErr: ErrRuntimeOutOfRange},
+	}
+
+	for _, tt := range tests {
+		got, err := RuntimeFromMinutes(tt.minutes)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%d: got error %v; want %v", tt.minutes, err, tt.wantErr)
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%d: got %d seconds; want %d", tt.minutes, got, tt.want)
+		}
+	}
+}
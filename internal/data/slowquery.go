@@ -0,0 +1,29 @@
+package data
+
+import "time"
+
+// SlowQueryLogger 记录执行时间超过阈值的模型查询。为nil时track直接返回，不会调用time.Now
+type SlowQueryLogger struct {
+	threshold time.Duration
+	log       func(operation string, duration time.Duration)
+}
+
+func NewSlowQueryLogger(threshold time.Duration, log func(operation string, duration time.Duration)) *SlowQueryLogger {
+	return &SlowQueryLogger{threshold: threshold, log: log}
+}
+
+// track 在模型方法的开头使用：defer m.SlowQueries.track("movies.GetAll")()
+func (s *SlowQueryLogger) track(operation string) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+
+	return func() {
+		duration := time.Since(start)
+		if duration >= s.threshold {
+			s.log(operation, duration)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Stats 是管理后台使用的汇总统计信息
+type Stats struct {
+	Movies struct {
+		Total     int           `json:"total"`
+		ByDecade  []DecadeCount `json:"by_decade"`
+		TopGenres []GenreCount  `json:"top_genres"`
+	} `json:"movies"`
+	Users struct {
+		Total          int     `json:"total"`
+		Activated      int     `json:"activated"`
+		ActivatedRatio float64 `json:"activated_ratio"`
+	} `json:"users"`
+}
+
+type DecadeCount struct {
+	Decade int `json:"decade"`
+	Count  int `json:"count"`
+}
+
+type GenreCount struct {
+	Genre string `json:"genre"`
+	Count int    `json:"count"`
+}
+
+type StatsModel struct {
+	DB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
+}
+
+// Get 执行所有的汇总查询，所有查询共用一个5秒的超时，topGenres是返回的最常见类型的数量
+func (m StatsModel) Get(ctx context.Context, topGenres int) (*Stats, error) {
+	ctx, span := m.Tracer.Start(ctx, "stats.Get")
+	defer span.End()
+	defer m.SlowQueries.track("stats.Get")()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var stats Stats
+
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM movies WHERE deleted_at IS NULL`).Scan(&stats.Movies.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按年代统计movie数量
+	rows, err := m.DB.QueryContext(ctx, `
+			SELECT (year / 10) * 10 AS decade, count(*)
+			FROM movies
+			WHERE deleted_at IS NULL
+			GROUP BY decade
+			ORDER BY decade ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.Movies.ByDecade = []DecadeCount{}
+
+	for rows.Next() {
+		var dc DecadeCount
+
+		err := rows.Scan(&dc.Decade, &dc.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Movies.ByDecade = append(stats.Movies.ByDecade, dc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 展开genres数组后按类型统计
+	rows, err = m.DB.QueryContext(ctx, `
+			SELECT genre, count(*)
+			FROM movies, unnest(genres) AS genre
+			WHERE deleted_at IS NULL
+			GROUP BY genre
+			ORDER BY count(*) DESC, genre ASC
+			LIMIT $1`, topGenres)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.Movies.TopGenres = []GenreCount{}
+
+	for rows.Next() {
+		var gc GenreCount
+
+		err := rows.Scan(&gc.Genre, &gc.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Movies.TopGenres = append(stats.Movies.TopGenres, gc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = m.DB.QueryRowContext(ctx, `SELECT count(*), count(*) FILTER (WHERE activated) FROM users`).Scan(
+		&stats.Users.Total,
+		&stats.Users.Activated,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.Users.Total > 0 {
+		stats.Users.ActivatedRatio = float64(stats.Users.Activated) / float64(stats.Users.Total)
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// 每个连接池最多缓存的语句数。列表查询的ORDER BY是拼接出来的，不同的排序会产生不同的SQL，
+// 超过上限之后的新语句不再预处理，直接发送SQL文本
+const maxCachedStatements = 256
+
+// StmtCache 包装一个连接池，第一次执行某条SQL时预处理并缓存*sql.Stmt，之后复用。
+// database/sql会在每个连接上第一次使用语句时自动重新预处理，所以一条缓存对应连接池中所有的连接。
+//
+// 默认不启用，需要设置-db-prepare-statements。注意：
+//   - 在pgbouncer的transaction pooling模式下预处理语句无法使用，不能开启-db-prepare-statements
+//   - 运行中修改表结构后PostgreSQL可能返回"cached plan must not change result type"，迁移之后需要重启服务器
+type StmtCache struct {
+	db *sql.DB
+
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func NewStmtCache(db *sql.DB) *StmtCache {
+	return &StmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// 返回缓存的语句，没有时预处理。缓存已满时返回nil；预处理失败时返回错误，不缓存。
+// 这两种情况调用方都直接使用连接池执行，预处理失败的原因(例如语法错误，连接断开)会在执行时同样返回
+func (c *StmtCache) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.RLock()
+	stmt, ok := c.stmts[query]
+	full := len(c.stmts) >= maxCachedStatements
+	c.mu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+	if full {
+		return nil, nil
+	}
+
+	// 预处理需要一次网络往返，不能持有锁，否则一次缓存未命中会阻塞其他所有查询
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 其他goroutine可能同时预处理了同一条语句，使用先放入缓存的那个
+	if cached, ok := c.stmts[query]; ok {
+		stmt.Close()
+		return cached, nil
+	}
+	if len(c.stmts) >= maxCachedStatements {
+		stmt.Close()
+		return nil, nil
+	}
+	c.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+func (c *StmtCache) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := c.stmt(ctx, query)
+	if err != nil || stmt == nil {
+		return c.db.ExecContext(ctx, query, args...)
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (c *StmtCache) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := c.stmt(ctx, query)
+	if err != nil || stmt == nil {
+		return c.db.QueryContext(ctx, query, args...)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (c *StmtCache) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := c.stmt(ctx, query)
+	if err != nil || stmt == nil {
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// Close 关闭所有缓存的语句，不关闭连接池本身
+func (c *StmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for query, stmt := range c.stmts {
+		err := stmt.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.stmts, query)
+	}
+
+	return firstErr
+}
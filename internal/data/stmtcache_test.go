@@ -0,0 +1,198 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeStmtDriver 记录Prepare的次数，所有语句都返回一行只有一列的结果
+type fakeStmtDriver struct {
+	prepares atomic.Int64
+}
+
+func (d *fakeStmtDriver) Open(name string) (driver.Conn, error) {
+	return &fakeStmtConn{driver: d}, nil
+}
+
+type fakeStmtConn struct {
+	driver *fakeStmtDriver
+}
+
+func (c *fakeStmtConn) Prepare(query string) (driver.Stmt, error) {
+	c.driver.prepares.Add(1)
+	return fakeStmt{}, nil
+}
+
+func (c *fakeStmtConn) Close() error { return nil }
+
+func (c *fakeStmtConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions not supported")
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeValueRows{}, nil
+}
+
+type fakeValueRows struct {
+	done bool
+}
+
+func (r *fakeValueRows) Columns() []string { return []string{"value"} }
+func (r *fakeValueRows) Close() error      { return nil }
+
+func (r *fakeValueRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+var registerFakeStmtDriver sync.Once
+
+func TestStmtCachePreparesOnce(t *testing.T) {
+	registerFakeStmtDriver.Do(func() {
+		sql.Register("fakestmt", &fakeStmtDriver{})
+	})
+
+	db, err := sql.Open("fakestmt", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// 只有一个连接，语句只需要在这个连接上预处理一次
+	db.SetMaxOpenConns(1)
+
+	d := db.Driver().(*fakeStmtDriver)
+	d.prepares.Store(0)
+
+	cache := NewStmtCache(db)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		var value int
+		err := cache.QueryRowContext(ctx, "SELECT 1", i).Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cache.ExecContext(ctx, "UPDATE t SET x = 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := d.prepares.Load(); got != 2 {
+		t.Errorf("got %d prepares; want 2", got)
+	}
+
+	err = cache.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.stmts) != 0 {
+		t.Errorf("got %d cached statements after Close; want 0", len(cache.stmts))
+	}
+}
+
+// 并发的缓存未命中各自预处理，只有一个语句留在缓存中，其余的被关闭
+func TestStmtCacheConcurrentMiss(t *testing.T) {
+	registerFakeStmtDriver.Do(func() {
+		sql.Register("fakestmt", &fakeStmtDriver{})
+	})
+
+	db, err := sql.Open("fakestmt", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cache := NewStmtCache(db)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var value int
+			err := cache.QueryRowContext(context.Background(), "SELECT 1").Scan(&value)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(cache.stmts) != 1 {
+		t.Errorf("got %d cached statements; want 1", len(cache.stmts))
+	}
+}
+
+// 驱动不支持预处理时直接执行SQL
+func TestStmtCacheFallsBackWhenPrepareFails(t *testing.T) {
+	models := NewModels(newFakeUsersDB(t), ModelOptions{PrepareStatements: true})
+
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+	err := models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 {
+		t.Error("user id was not set")
+	}
+}
+
+// 比较使用和不使用预处理语句时MovieModel.Get的耗时，需要设置GREENLIGHT_TEST_DB_DSN:
+//
+//	go test ./internal/data -run '^$' -bench MovieGet
+func BenchmarkMovieGet(b *testing.B) {
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		b.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	movie := &Movie{Title: "Benchmark", Year: 2020, Runtime: Runtime(100 * 60), Genres: []string{"drama"}}
+	err = NewModels(db, ModelOptions{}).Movies.Insert(context.Background(), movie)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM movies WHERE id = $1", movie.ID)
+
+	for _, prepare := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prepare=%t", prepare), func(b *testing.B) {
+			models := NewModels(db, ModelOptions{PrepareStatements: prepare})
+			defer models.Close()
+
+			for i := 0; i < b.N; i++ {
+				_, err := models.Movies.Get(context.Background(), movie.ID)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
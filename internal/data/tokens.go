@@ -4,9 +4,10 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
+	"fmt"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
@@ -14,13 +15,25 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	// 已激活的用户重新验证邮件地址，刷新verified_at
+	ScopeVerification = "verification"
+	// 已经使用过的激活令牌留下的墓碑，只用于识别重复的激活请求，不能再用来激活
+	ScopeActivationUsed = "activation_used"
 )
 
+// 激活令牌墓碑的有效期，过期后重复使用同一个令牌得到的是令牌无效的错误
+const usedActivationTTL = 24 * time.Hour
+
+// TokenSortSafelist 是令牌列表允许的排序字段，默认按创建时间倒序
+var TokenSortSafelist = []string{"created_at", "expiry", "-created_at", "-expiry"}
+
 // 要当做JSON响应传回
 type Token struct {
-	Plaintext string    `json:"token"`
+	// 明文只在创建时返回，从数据库中读出的令牌没有明文
+	Plaintext string    `json:"token,omitempty"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
 }
@@ -28,10 +41,12 @@ type Token struct {
 // 为指定用户id和类型产生Token
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	// We add the provided ttl duration parameter to the current time to get expiry time
+	now := time.Now()
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		CreatedAt: now,
+		Expiry:    now.Add(ttl),
+		Scope:     scope,
 	}
 
 	// Initialize a zero-valued byte slice with a length of 16 bytes
@@ -62,28 +77,36 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
 }
 
 // New creates a new Token and inserts the data in the tokens table
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert adds the data for a specific token to the tokens table
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := m.Tracer.Start(ctx, "tokens.Insert")
+	defer span.End()
+	defer m.SlowQueries.track("tokens.Insert")()
+
 	query := `
-			INSERT INTO tokens (hash, user_id, expiry, scope)
-			VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+			INSERT INTO tokens (hash, user_id, created_at, expiry, scope)
+			VALUES ($1, $2, $3, $4, $5)`
+	args := []interface{}{token.Hash, token.UserID, token.CreatedAt, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -91,12 +114,82 @@ func (m TokenModel) Insert(token *Token) error {
 }
 
 // 删除指定id和scope的tokens
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := m.Tracer.Start(ctx, "tokens.DeleteAllForUser")
+	defer span.End()
+	defer m.SlowQueries.track("tokens.DeleteAllForUser")()
+
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// MarkActivationUsed 在激活成功后调用：删除该用户所有的激活令牌，再用刚使用的令牌的哈希写入一个短期的墓碑，
+// 重复提交同一个令牌时可以返回已经激活的提示，而不是让令牌在剩下的有效期内仍然可以使用
+func (m TokenModel) MarkActivationUsed(ctx context.Context, tokenPlaintext string, userID int64) error {
+	err := m.DeleteAllForUser(ctx, ScopeActivation, userID)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	now := time.Now()
+
+	return m.Insert(ctx, &Token{
+		Hash:      hash[:],
+		UserID:    userID,
+		CreatedAt: now,
+		Expiry:    now.Add(usedActivationTTL),
+		Scope:     ScopeActivationUsed,
+	})
+}
+
+// GetAllForUser 按filters分页返回指定用户某一类型下未过期的令牌，不包含明文。
+// 令牌没有id，创建时间相同时按哈希排序保证分页稳定
+func (m TokenModel) GetAllForUser(ctx context.Context, scope string, userID int64, filters Filters) ([]*Token, Metadata, error) {
+	ctx, span := m.Tracer.Start(ctx, "tokens.GetAllForUser")
+	defer span.End()
+	defer m.SlowQueries.track("tokens.GetAllForUser")()
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), user_id, created_at, expiry, scope
+			FROM tokens
+			WHERE scope = $1 AND user_id = $2 AND expiry > $3
+			ORDER BY %s
+			LIMIT $4 OFFSET $5`, filters.orderBy("hash"))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now(), filters.limit(), filters.Offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+
+		err := rows.Scan(&totalRecords, &token.UserID, &token.CreatedAt, &token.Expiry, &token.Scope)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tokens, metadata, nil
+}
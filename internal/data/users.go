@@ -8,11 +8,17 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/LTXWorld/greenLight_copy/internal/validator"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
+// 列出用户时允许的排序字段。开启了email加密时按email排序的是密文，顺序没有意义
+var UserSortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
 // Define a custom ErrDuplicateEmail error
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
@@ -21,13 +27,15 @@ var (
 
 // We ignore the password and version during the JSON
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	Password   password   `json:"-"`
+	Activated  bool       `json:"activated"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"` // 最近一次验证邮件的时间，从未验证过为nil
+	Version    int        `json:"version"`               // 与movie一样暴露给客户端，用于PATCH时的冲突检测
 }
 
 // Check if a User instance is the AnonymousUser
@@ -35,6 +43,15 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// VerifiedWithin 检查用户是否在最近maxAge时间内验证过邮件
+func (u *User) VerifiedWithin(maxAge time.Duration) bool {
+	if u.VerifiedAt == nil {
+		return false
+	}
+
+	return time.Since(*u.VerifiedAt) <= maxAge
+}
+
 // 明文密码和hash后的密码
 type password struct {
 	plaintext *string
@@ -72,22 +89,64 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
+	// Get、GetAll、GetByEmail和GetForToken使用的只读副本，为nil时使用DB
+	ReadDB DBTX
+	// 慢查询日志，为nil时不记录
+	SlowQueries *SlowQueryLogger
+	// 为每次查询创建span，未开启追踪时为noop实现
+	Tracer trace.Tracer
+	// 设置后email列中保存的是密文，为nil时保存明文
+	Cipher *EmailCipher
+}
+
+// NormalizeEmail 将邮件地址统一为小写。email列虽然是citext，但加密后的密文是区分大小写的，
+// 所以在写入和查询之前统一转换，保证不同大小写的同一地址被视为同一个用户
+func NormalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// 将要写入或者用于查询的邮件转换为数据库中保存的形式
+func (m UserModel) encryptEmail(email string) string {
+	if m.Cipher == nil {
+		return email
+	}
+	return m.Cipher.Encrypt(email)
+}
+
+// 将从数据库中读取到的邮件解密回明文
+func (m UserModel) decryptEmail(user *User) error {
+	if m.Cipher == nil {
+		return nil
+	}
+
+	email, err := m.Cipher.Decrypt(user.Email)
+	if err != nil {
+		return err
+	}
+
+	user.Email = email
+	return nil
 }
 
 // Insert 插入时注意检查email重复
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := m.Tracer.Start(ctx, "users.Insert")
+	defer span.End()
+	defer m.SlowQueries.track("users.Insert")()
+
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+		RETURNING id, created_at, updated_at, version`
+	user.Email = NormalizeEmail(user.Email)
+	args := []interface{}{user.Name, m.encryptEmail(user.Email), user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// err:如果email出现重复
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -100,21 +159,27 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := m.Tracer.Start(ctx, "users.GetByEmail")
+	defer span.End()
+	defer m.SlowQueries.track("users.GetByEmail")()
+
 	query := `
-			SELECT id, created_at, name, email, password_hash, activated, version
+			SELECT id, created_at, updated_at, name, email, password_hash, activated, verified_at, version
 			FROM users
 			WHERE email = $1`
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := reader(ctx, m.DB, m.ReadDB).QueryRowContext(ctx, query, m.encryptEmail(NormalizeEmail(email))).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.VerifiedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -125,27 +190,154 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 			return nil, err
 		}
 	}
+
+	err = m.decryptEmail(&user)
+	if err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
 
+// Get 根据id获取用户，管理接口中使用
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	ctx, span := m.Tracer.Start(ctx, "users.Get")
+	defer span.End()
+	defer m.SlowQueries.track("users.Get")()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+			SELECT id, created_at, updated_at, name, email, password_hash, activated, verified_at, version
+			FROM users
+			WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err := reader(ctx, m.DB, m.ReadDB).QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.VerifiedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = m.decryptEmail(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetAll 分页列出用户，search不区分大小写地匹配name或email的一部分，activated为nil时不按激活状态过滤。
+// 开启了email加密时无法在密文中查找子串，email只能完整匹配
+func (m UserModel) GetAll(ctx context.Context, search string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	ctx, span := m.Tracer.Start(ctx, "users.GetAll")
+	defer span.End()
+	defer m.SlowQueries.track("users.GetAll")()
+
+	// $2是转换成数据库中保存形式的search
+	emailMatch := "strpos(email, $2) > 0"
+	if m.Cipher != nil {
+		emailMatch = "email = $2"
+	}
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, updated_at, name, email, activated, verified_at, version
+				FROM users
+				WHERE ($1 = '' OR strpos(lower(name), lower($1)) > 0 OR %s)
+				AND ($3::boolean IS NULL OR activated = $3)
+				ORDER BY %s
+				LIMIT $4 OFFSET $5`, emailMatch, filters.orderBy("id"))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{search, m.encryptEmail(NormalizeEmail(search)), activated, filters.limit(), filters.Offset()}
+
+	rows, err := reader(ctx, m.DB, m.ReadDB).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		// 不读取password_hash，列表中的用户只用于展示
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.VerifiedAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = m.decryptEmail(&user)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 // Update 根据特定id和version（防止数据竞争）来进行更新
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := m.Tracer.Start(ctx, "users.Update")
+	defer span.End()
+	defer m.SlowQueries.track("users.Update")()
+
 	query := `
 			UPDATE users
-			SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			WHERE id = $5 AND version = $6
-			RETURNING version`
+			SET name = $1, email = $2, password_hash = $3, activated = $4, verified_at = $5, version = version + 1,
+				updated_at = NOW()
+			WHERE id = $6 AND version = $7
+			RETURNING version, updated_at`
+	user.Email = NormalizeEmail(user.Email)
 	args := []interface{}{
 		user.Name,
-		user.Email,
+		m.encryptEmail(user.Email),
 		user.Password.hash,
 		user.Activated,
+		user.VerifiedAt,
 		user.ID,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version, &user.UpdatedAt)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -167,14 +359,13 @@ func ValidateEmail(v *validator.Validator, email string) {
 }
 
 // ValidatePasswordPlaintext 验证用户传来的明文密码的格式
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+func ValidatePasswordPlaintext(v *validator.Validator, password string, policy PasswordPolicy) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	policy.check(v, password)
 }
 
 // ValidateUser 检查用户名，密码，邮件是否满足格式要求
-func ValidateUser(v *validator.Validator, user *User) {
+func ValidateUser(v *validator.Validator, user *User, policy PasswordPolicy) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 
@@ -182,7 +373,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, policy)
 	}
 
 	// 这里跟用户的输入没关系，来自于可能发生在代码逻辑中的错误
@@ -192,13 +383,17 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 // GetForToken 通过令牌类型和明文令牌来获取用户信息
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := m.Tracer.Start(ctx, "users.GetForToken")
+	defer span.End()
+	defer m.SlowQueries.track("users.GetForToken")()
+
 	// 先将用户传来的明文token进行加密
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	// SQL query，根据id进行内连接
-	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash,
-				users.activated, users.version
+	query := `SELECT users.id, users.created_at, users.updated_at, users.name, users.email, users.password_hash,
+				users.activated, users.verified_at, users.version
 				FROM users
 				INNER JOIN tokens
 				ON users.id = tokens.user_id
@@ -210,17 +405,19 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	// Execute the query
+	// 令牌总是从主库读取：刚创建的令牌可能还没有同步到副本，读到的用户之后也常常被更新
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.VerifiedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -232,5 +429,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 
+	err = m.decryptEmail(&user)
+	if err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
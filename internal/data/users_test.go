@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUsersDriver 模拟users表上email列的唯一约束，只支持UserModel.Insert中的INSERT语句。
+// 比较是区分大小写的，和加密后的email列一样，citext在这种情况下无法起作用
+type fakeUsersDriver struct {
+	mu     sync.Mutex
+	emails map[string]bool
+}
+
+func (d *fakeUsersDriver) Open(name string) (driver.Conn, error) {
+	return &fakeUsersConn{driver: d}, nil
+}
+
+type fakeUsersConn struct {
+	driver *fakeUsersDriver
+}
+
+func (c *fakeUsersConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (c *fakeUsersConn) Close() error { return nil }
+
+func (c *fakeUsersConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+func (c *fakeUsersConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "INSERT INTO users") {
+		return nil, errors.New("unexpected query")
+	}
+
+	email := args[1].Value.(string)
+
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+
+	if c.driver.emails[email] {
+		return nil, errors.New(`pq: duplicate key value violates unique constraint "users_email_key"`)
+	}
+	c.driver.emails[email] = true
+
+	return &fakeInsertRows{id: int64(len(c.driver.emails))}, nil
+}
+
+// INSERT ... RETURNING id, created_at, updated_at, version 返回的单行结果
+type fakeInsertRows struct {
+	id   int64
+	done bool
+}
+
+func (r *fakeInsertRows) Columns() []string {
+	return []string{"id", "created_at", "updated_at", "version"}
+}
+
+func (r *fakeInsertRows) Close() error { return nil }
+
+func (r *fakeInsertRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+
+	dest[0] = r.id
+	dest[1] = time.Now()
+	dest[2] = time.Now()
+	dest[3] = int64(1)
+	return nil
+}
+
+var registerFakeUsersDriver sync.Once
+
+func newFakeUsersDB(t *testing.T) *sql.DB {
+	registerFakeUsersDriver.Do(func() {
+		sql.Register("fakeusers", &fakeUsersDriver{})
+	})
+
+	db, err := sql.Open("fakeusers", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// 每个测试使用独立的email集合
+	db.Driver().(*fakeUsersDriver).emails = make(map[string]bool)
+
+	return db
+}
+
+func TestInsertEmailCaseInsensitive(t *testing.T) {
+	cipher, err := NewEmailCipher(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cipher *EmailCipher
+	}{
+		{name: "plaintext", cipher: nil},
+		{name: "encrypted", cipher: cipher},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			models := NewModels(newFakeUsersDB(t), ModelOptions{EmailCipher: tt.cipher})
+
+			first := &User{Name: "Alice", Email: "alice@example.com"}
+			err := models.Users.Insert(context.Background(), first)
+			if err != nil {
+				t.Fatalf("first insert: %v", err)
+			}
+
+			second := &User{Name: "Alice", Email: "Alice@Example.COM"}
+			err = models.Users.Insert(context.Background(), second)
+			if !errors.Is(err, ErrDuplicateEmail) {
+				t.Fatalf("second insert: got %v; want %v", err, ErrDuplicateEmail)
+			}
+
+			if second.Email != "alice@example.com" {
+				t.Errorf("email not normalized: got %q", second.Email)
+			}
+		})
+	}
+}
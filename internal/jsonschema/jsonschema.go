@@ -0,0 +1,227 @@
+// Package jsonschema 实现了JSON Schema中常用的一部分关键字，用于在反序列化之前对请求体做更严格的检查。
+// 支持的关键字：type, enum, required, properties, additionalProperties(布尔值),
+// minLength, maxLength, pattern, minimum, maximum, items, minItems, maxItems, uniqueItems
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/LTXWorld/greenLight_copy/internal/validator"
+)
+
+// Schema 是解析后的schema文档，嵌套的properties和items同样是Schema
+type Schema struct {
+	Type                 string             `json:"type"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	UniqueItems          bool               `json:"uniqueItems"`
+
+	pattern *regexp.Regexp
+}
+
+// Compile 解析schema文档并预先编译其中所有的正则表达式
+func Compile(doc []byte) (*Schema, error) {
+	var s Schema
+
+	err := json.Unmarshal(doc, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		rx, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = rx
+	}
+
+	for _, prop := range s.Properties {
+		err := prop.compile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+
+	return nil
+}
+
+// Validate 检查JSON文档是否满足schema，错误以字段路径为键写入Validator，与其他校验的输出保持一致。
+// 文档本身不是合法JSON时返回error，由调用方决定如何处理
+func (s *Schema) Validate(v *validator.Validator, doc []byte) error {
+	var value interface{}
+
+	err := json.Unmarshal(doc, &value)
+	if err != nil {
+		return err
+	}
+
+	s.validate(v, "body", value)
+	return nil
+}
+
+func (s *Schema) validate(v *validator.Validator, path string, value interface{}) {
+	if s.Type != "" && !matchesType(s.Type, value) {
+		v.AddError(path, fmt.Sprintf("must be of type %s", s.Type))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equal(e, value) {
+				found = true
+				break
+			}
+		}
+		v.Check(found, path, "must be one of the allowed values")
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := len([]rune(value))
+		if s.MinLength != nil {
+			v.Check(length >= *s.MinLength, path, fmt.Sprintf("must be at least %d characters long", *s.MinLength))
+		}
+		if s.MaxLength != nil {
+			v.Check(length <= *s.MaxLength, path, fmt.Sprintf("must not be more than %d characters long", *s.MaxLength))
+		}
+		if s.pattern != nil {
+			v.Check(s.pattern.MatchString(value), path, "must match the required format")
+		}
+
+	case float64:
+		if s.Minimum != nil {
+			v.Check(value >= *s.Minimum, path, fmt.Sprintf("must be greater than or equal to %v", *s.Minimum))
+		}
+		if s.Maximum != nil {
+			v.Check(value <= *s.Maximum, path, fmt.Sprintf("must be less than or equal to %v", *s.Maximum))
+		}
+
+	case []interface{}:
+		if s.MinItems != nil {
+			v.Check(len(value) >= *s.MinItems, path, fmt.Sprintf("must contain at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil {
+			v.Check(len(value) <= *s.MaxItems, path, fmt.Sprintf("must not contain more than %d items", *s.MaxItems))
+		}
+		if s.UniqueItems {
+			v.Check(uniqueItems(value), path, "must not contain duplicate values")
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.validate(v, fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				v.AddError(joinPath(path, name), "must be provided")
+			}
+		}
+		for name, prop := range value {
+			propSchema, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					v.AddError(joinPath(path, name), "is not an allowed field")
+				}
+				continue
+			}
+			propSchema.validate(v, joinPath(path, name), prop)
+		}
+	}
+}
+
+// 顶层字段直接使用字段名作为键，和ValidateMovie等方法产生的错误键一致
+func joinPath(path, name string) string {
+	if path == "body" {
+		return name
+	}
+	return path + "." + name
+}
+
+// 判断值是否是schema中声明的类型，integer要求数字没有小数部分
+func matchesType(typ string, value interface{}) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	default:
+		return false
+	}
+}
+
+// 通过重新序列化比较两个JSON值是否相等，对于小的请求体足够使用
+func equal(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ja) == string(jb)
+}
+
+func uniqueItems(items []interface{}) bool {
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		js, err := json.Marshal(item)
+		if err != nil {
+			return false
+		}
+		key := string(js)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+
+	return true
+}
@@ -2,9 +2,14 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"fmt"
+	"github.com/LTXWorld/greenLight_copy/internal/jsonlog"
 	"github.com/go-mail/mail/v2"
 	"html/template"
+	"io/fs"
+	netmail "net/mail"
 	"time"
 )
 
@@ -14,50 +19,126 @@ var (
 	templateFS embed.FS
 )
 
-// Define a Mailer struct which contains a mail.Dialer instance(used to connect to a SMTP server)
+// Mailer 使用templates中的模版渲染并发送邮件，SMTPMailer通过SMTP服务器发送，LogMailer只写日志。
+// 测试中可以替换为不发送邮件的实现
+type Mailer interface {
+	Send(recipient, templateFile string, data interface{}) error
+	// SendContext 与Send相同，ctx结束后不再重试
+	SendContext(ctx context.Context, recipient, templateFile string, data interface{}) error
+}
+
+// Define a SMTPMailer struct which contains a mail.Dialer instance(used to connect to a SMTP server)
 // And the name and address you want the email to be from(sender)
-type Mailer struct {
+type SMTPMailer struct {
 	dialer *mail.Dialer
-	sender string
+	sender *netmail.Address
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
+// New 中的sender可以是单纯的地址，也可以带有显示名称，例如"Greenlight Support <support@example.com>"
+func New(host string, port int, username, password, sender string) (SMTPMailer, error) {
+	// 启动时就解析发件人地址，避免等到发送邮件时才发现格式错误
+	from, err := netmail.ParseAddress(sender)
+	if err != nil {
+		return SMTPMailer{}, err
+	}
+
 	// Initialize a new mail.Dialer instance with the given SMTP server settings
 	// 这是一个SMTP连接拨号器，通过拨号器连接SMTP服务器
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	// Return a Mailer instance
-	return Mailer{
+	// Return a SMTPMailer instance
+	return SMTPMailer{
 		dialer: dialer,
-		sender: sender,
+		sender: from,
+	}, nil
+}
+
+// ParseTemplates 解析所有嵌入的邮件模版，并检查每个模版都定义了subject和plainBody
+func ParseTemplates() error {
+	files, err := fs.Glob(templateFS, "templates/*.tmpl")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		tmpl, err := template.New("email").ParseFS(templateFS, file)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"subject", "plainBody"} {
+			if tmpl.Lookup(name) == nil {
+				return fmt.Errorf("%s: missing %q template", file, name)
+			}
+		}
 	}
+
+	return nil
 }
 
-// Send() takes the recipient email address as the first p,the name of file containing the templates,
-// and any dynamic data for the templates as an interface{} p
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// Check 连接SMTP服务器并完成认证后立即断开，用于在启动时发现错误的配置
+func (m SMTPMailer) Check() error {
+	conn, err := m.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// 渲染后的邮件内容，模版中没有定义htmlBody时htmlBody为空
+type message struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+// 使用指定的模版文件渲染邮件的主题和正文
+func render(templateFile string, data interface{}) (*message, error) {
 	// Use the ParseFS() to parse the required template file from the embedded file system
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Execute the named template "subject",passing in the dynamic data and storing the result
 	// in a bytes.Buffer
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// htmlBody是可选的，模版中没有定义时只发送纯文本邮件
 	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if tmpl.Lookup("htmlBody") != nil {
+		err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &message{
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
+}
+
+// Send() takes the recipient email address as the first p,the name of file containing the templates,
+// and any dynamic data for the templates as an interface{} p
+func (m SMTPMailer) Send(recipient, templateFile string, data interface{}) error {
+	return m.SendContext(context.Background(), recipient, templateFile, data)
+}
+
+// SendContext 在每次尝试之前以及重试的等待期间检查ctx，单次SMTP会话本身受dialer的超时限制
+func (m SMTPMailer) SendContext(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	rendered, err := render(templateFile, data)
 	if err != nil {
 		return err
 	}
@@ -65,13 +146,23 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	//
 	msg := mail.NewMessage()
 	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	// 使用SetAddressHeader让go-mail负责显示名称的引号和编码
+	msg.SetAddressHeader("From", m.sender.Address, m.sender.Name)
+	msg.SetHeader("Subject", rendered.subject)
+	msg.SetBody("text/plain", rendered.plainBody)
+	if rendered.htmlBody != "" {
+		msg.AddAlternative("text/html", rendered.htmlBody)
+	}
 
 	// 尝试发送三次
 	for i := 1; i <= 3; i++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err != nil {
+				return err
+			}
+			return ctxErr
+		}
+
 		// Call the DialAndSend() on the dialer,this opens a connection to SMTP server,sends the message
 		// then closes the connection
 		err = m.dialer.DialAndSend(msg)
@@ -80,8 +171,40 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 			return nil
 		}
 		// If it didn't work, sleep for a short time and retry
-		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
 	}
 
 	return err
 }
+
+// LogMailer 不连接SMTP服务器，只把渲染后的纯文本邮件写入日志，用于没有SMTP服务器的本地开发环境
+type LogMailer struct {
+	logger *jsonlog.Logger
+}
+
+func NewLogMailer(logger *jsonlog.Logger) LogMailer {
+	return LogMailer{logger: logger}
+}
+
+func (m LogMailer) Send(recipient, templateFile string, data interface{}) error {
+	return m.SendContext(context.Background(), recipient, templateFile, data)
+}
+
+func (m LogMailer) SendContext(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	rendered, err := render(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.logger.PrintInfo("email not sent, smtp disabled", map[string]string{
+		"recipient": recipient,
+		"template":  templateFile,
+		"subject":   rendered.subject,
+		"body":      rendered.plainBody,
+	})
+
+	return nil
+}
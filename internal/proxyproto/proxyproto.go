@@ -0,0 +1,223 @@
+// Package proxyproto 解析负载均衡器在TCP连接开头发送的PROXY protocol(v1文本格式和v2二进制格式)头，
+// 使连接的RemoteAddr返回真实的客户端地址。
+// 只能在所有连接都来自可信的、会发送PROXY头的负载均衡器时使用：客户端可以直接连接时能够伪造任意地址
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2头的12字节签名
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1头最长107字节（包括结尾的\r\n）
+const v1MaxLength = 107
+
+var ErrNoHeader = errors.New("proxyproto: connection did not start with a PROXY protocol header")
+
+// Listener 包装net.Listener，Accept返回的连接在第一次Read或者RemoteAddr时读取PROXY头。
+// 头在连接自己的goroutine中读取，不会阻塞Accept
+type Listener struct {
+	net.Listener
+	// 读取PROXY头的超时时间，为0时不限制
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.HeaderTimeout,
+	}, nil
+}
+
+type Conn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	once       sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// Read 读取PROXY头之后的数据，头不合法时返回错误，调用方会关闭连接
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr 返回PROXY头中的源地址，头中没有地址(LOCAL命令或者UNKNOWN)时返回原始连接的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.headerTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	c.remoteAddr, c.localAddr, c.headerErr = ReadHeader(c.reader)
+}
+
+// ReadHeader 从r中读取并解析一个PROXY头，返回其中的源地址和目的地址，没有地址信息时两者都为nil
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// 最短的v1头"PROXY UNKNOWN\r\n"也比v2签名长，数据不足12字节时一定不是合法的头
+	peek, err := r.Peek(len(v2Signature))
+
+	switch {
+	case bytes.Equal(peek, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return readV1(r)
+	case err != nil:
+		return nil, nil, err
+	default:
+		return nil, nil, ErrNoHeader
+	}
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, nil, errors.New("proxyproto: v1 header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxyproto: v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func v1Addr(proto, ip, port string) (net.Addr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP4") != (addr.To4() != nil) {
+		return nil, fmt.Errorf("proxyproto: invalid %s address %q", proto, ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var header [16]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	// 地址后面可能还有TLV，读出整个地址块然后忽略TLV
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	// LOCAL: 负载均衡器自己的连接(例如健康检查)，使用原始连接的地址
+	case 0x0:
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 command %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	// TCP over IPv4
+	case 0x11:
+		ipLen = net.IPv4len
+	// TCP over IPv6
+	case 0x21:
+		ipLen = net.IPv6len
+	// UDP、Unix socket以及未指定的协议不包含可用的TCP地址
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("proxyproto: v2 address block is too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return src, dst, nil
+}
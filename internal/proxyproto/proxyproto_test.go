@@ -0,0 +1,104 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func v2Header(command, family byte, payload []byte) string {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	// 地址后面带一个TLV，应该被忽略
+	tcp4WithTLV := append(append([]byte{}, tcp4...), 0x01, 0x00, 0x02, 'h', '2')
+
+	tests := []struct {
+		name    string
+		input   string
+		src     string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /", src: "192.0.2.1:56324"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /", src: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nGET /", src: ""},
+		{name: "v1 mismatched family", input: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\nGET /", wantErr: true},
+		{name: "v1 missing crlf", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\nGET /", wantErr: true},
+		{name: "v2 tcp4", input: v2Header(0x1, 0x11, tcp4) + "GET /", src: "192.0.2.1:56324"},
+		{name: "v2 tcp4 with tlv", input: v2Header(0x1, 0x11, tcp4WithTLV) + "GET /", src: "192.0.2.1:56324"},
+		{name: "v2 local", input: v2Header(0x0, 0x00, nil) + "GET /", src: ""},
+		{name: "v2 short address", input: v2Header(0x1, 0x11, tcp4[:4]) + "GET /", wantErr: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+
+			src, _, err := ReadHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := ""
+			if src != nil {
+				got = src.String()
+			}
+			if got != tt.src {
+				t.Errorf("got src %q; want %q", got, tt.src)
+			}
+
+			// 头后面的数据应该原样保留
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET /" {
+				t.Errorf("got remaining data %q; want %q", rest, "GET /")
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pln := &Listener{Listener: ln}
+	defer pln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	}()
+
+	conn, err := pln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("got RemoteAddr %q; want %q", got, "192.0.2.1:56324")
+	}
+
+	body, err := io.ReadAll(conn)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("got body %q; want %q", body, "hello")
+	}
+}
@@ -0,0 +1,70 @@
+// Package pwned 通过HaveIBeenPwned的range API检查密码是否出现在已泄露的数据中。
+// 只发送SHA-1哈希的前5个字符(k-anonymity)，完整的哈希和密码都不会离开本机
+package pwned
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://api.pwnedpasswords.com/range/"
+
+type Client struct {
+	client  *http.Client
+	baseURL string
+}
+
+func New(baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		client:  &http.Client{Timeout: timeout},
+		baseURL: baseURL,
+	}
+}
+
+// Breached 返回密码在泄露数据中出现的次数，0表示没有出现过
+func (c *Client) Breached(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	// 让响应包含随机的填充条目，避免通过响应大小推测出前缀
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("pwned passwords range request returned %s", res.Status)
+	}
+
+	// 每行的格式为 SUFFIX:COUNT，填充条目的COUNT为0
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		lineSuffix, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || lineSuffix != suffix {
+			continue
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, fmt.Errorf("invalid count in pwned passwords response: %w", err)
+		}
+		return n, nil
+	}
+
+	return 0, scanner.Err()
+}
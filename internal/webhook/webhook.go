@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Define constants for the movie lifecycle event types
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventMovieRestored = "movie.restored"
+)
+
+// Event 是POST给外部系统的JSON请求体
+type Event struct {
+	Type string      `json:"event"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Dispatcher 保存了所有的webhook目标地址，订阅的事件类型以及用于HMAC签名的密钥
+type Dispatcher struct {
+	client *http.Client
+	urls   []string
+	events map[string]bool
+	secret []byte
+}
+
+func New(urls, events []string, secret string) *Dispatcher {
+	d := &Dispatcher{
+		client: &http.Client{Timeout: 5 * time.Second},
+		urls:   urls,
+		events: make(map[string]bool),
+		secret: []byte(secret),
+	}
+
+	for _, event := range events {
+		d.events[event] = true
+	}
+
+	return d
+}
+
+// URLs 返回所有配置的目标地址
+func (d *Dispatcher) URLs() []string {
+	return d.urls
+}
+
+// Subscribed 判断某个事件类型是否需要被发送
+func (d *Dispatcher) Subscribed(eventType string) bool {
+	return d.events[eventType]
+}
+
+// Payload 将事件序列化为JSON，同一个事件发给所有目标(包括WebSocket客户端)时只需要序列化一次
+func Payload(eventType string, data interface{}) ([]byte, error) {
+	return json.Marshal(Event{
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	})
+}
+
+// sign 使用密钥计算请求体的HMAC-SHA256签名，接收方可以据此校验请求确实来自我们
+func (d *Dispatcher) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send 将payload POST到指定的url，非2xx的响应也视为失败，最多尝试三次
+func (d *Dispatcher) Send(url, eventType string, payload []byte) error {
+	var err error
+
+	for i := 1; i <= 3; i++ {
+		err = d.post(url, eventType, payload)
+		if nil == err {
+			return nil
+		}
+		// 最后一次失败之后直接返回，不再等待
+		if i == 3 {
+			break
+		}
+		// If it didn't work, sleep for a short time and retry
+		time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+	}
+
+	return err
+}
+
+func (d *Dispatcher) post(url, eventType string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Greenlight-Event", eventType)
+	if len(d.secret) > 0 {
+		req.Header.Set("X-Greenlight-Signature", d.sign(payload))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with status %d", url, res.StatusCode)
+	}
+
+	return nil
+}
@@ -1,5 +1,5 @@
-ALTER TABLE movies ADD CONSTRAINT IF EXISTS movies_runtime_check;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_runtime_check;
 
-ALTER TABLE movies ADD CONSTRAINT IF EXISTS movies_year_check;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_year_check;
 
-ALTER TABLE movies ADD CONSTRAINT IF EXISTS genres_length_check;
\ No newline at end of file
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS genres_length_check;
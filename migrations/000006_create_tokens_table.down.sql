@@ -1 +1 @@
-DROP TABLE IF EXISITS tokens;
\ No newline at end of file
+DROP TABLE IF EXISTS tokens;
\ No newline at end of file
@@ -0,0 +1,8 @@
+DELETE FROM movies WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS movies_change_seq_idx;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE movies DROP COLUMN IF EXISTS change_seq;
+
+DROP SEQUENCE IF EXISTS movies_change_seq;
@@ -0,0 +1,6 @@
+CREATE SEQUENCE IF NOT EXISTS movies_change_seq;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS change_seq bigint NOT NULL DEFAULT nextval('movies_change_seq');
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS movies_change_seq_idx ON movies (change_seq);
@@ -0,0 +1,3 @@
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS genres_length_check;
+
+ALTER TABLE movies ADD CONSTRAINT genres_length_check CHECK ( array_length(genres, 1) BETWEEN 1 AND 5);
@@ -0,0 +1,3 @@
+UPDATE movies SET runtime = round(runtime / 60.0);
+
+UPDATE movie_versions SET runtime = round(runtime / 60.0);
@@ -0,0 +1,3 @@
+UPDATE movies SET runtime = runtime * 60;
+
+UPDATE movie_versions SET runtime = runtime * 60;
@@ -0,0 +1,13 @@
+-- 启动时EnsureCodes可能已经创建了这个权限
+INSERT INTO permissions (code)
+SELECT 'movies:delete'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'movies:delete');
+
+-- 删除电影之前只需要movies:write，已经拥有movies:write的用户同时获得movies:delete，升级之后仍然可以删除
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT up.user_id, pd.id
+FROM users_permissions up
+INNER JOIN permissions pw ON pw.id = up.permission_id AND pw.code = 'movies:write'
+CROSS JOIN permissions pd
+WHERE pd.code = 'movies:delete'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+-- 无法区分回填的值和真正的验证时间，回退时不做任何修改
+SELECT 1;
@@ -0,0 +1,2 @@
+-- 000008之前激活的用户没有verified_at，以注册时间作为验证时间，过期后可以通过重新验证邮件刷新
+UPDATE users SET verified_at = created_at WHERE activated AND verified_at IS NULL;
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS movies_lock_change_seq ON movies;
+DROP FUNCTION IF EXISTS movies_lock_change_seq();
@@ -0,0 +1,17 @@
+-- change_seq在语句执行时分配，而不是在提交时。两个并发事务可能以与分配顺序相反的顺序提交，
+-- 客户端先读到较大的change_seq并把since推进过去，较小的那个提交之后就再也不会被返回。
+-- 每个写movies的语句在处理任何行之前先获取共享的事务级advisory lock，持有到事务结束。
+-- 写入之间互不阻塞；GetChanges在读取之前获取同一个锁的排他模式，等待所有已经分配了change_seq的事务结束，
+-- 这样读到某个change_seq时，比它小的都已经提交或回滚了。
+-- 锁在语句级触发器中获取，早于行锁，不会与行锁形成死锁
+CREATE OR REPLACE FUNCTION movies_lock_change_seq() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock_shared(hashtext('movies_change_seq'));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS movies_lock_change_seq ON movies;
+CREATE TRIGGER movies_lock_change_seq
+    BEFORE INSERT OR UPDATE ON movies
+    FOR EACH STATEMENT EXECUTE FUNCTION movies_lock_change_seq();
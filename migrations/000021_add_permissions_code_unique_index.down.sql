@@ -0,0 +1 @@
+DROP INDEX IF EXISTS permissions_code_idx;
@@ -0,0 +1,15 @@
+-- 之前EnsureCodes使用INSERT ... WHERE NOT EXISTS，并发启动的实例可能插入了重复的code。
+-- 先把授予重复行的权限转到id最小的那一行，再删除其余的行(users_permissions中的记录随之级联删除)
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT up.user_id, keep.id
+FROM users_permissions up
+INNER JOIN permissions p ON p.id = up.permission_id
+INNER JOIN (SELECT code, min(id) AS id FROM permissions GROUP BY code) keep ON keep.code = p.code
+WHERE p.id <> keep.id
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions p
+USING permissions keep
+WHERE keep.code = p.code AND keep.id < p.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_idx ON permissions (code);
@@ -0,0 +1,9 @@
+// Package migrations 将SQL迁移文件嵌入到二进制包中，这样部署时不再依赖外部的migrate工具
+package migrations
+
+import "embed"
+
+// FS 包含了该目录下所有的*.up.sql和*.down.sql迁移文件
+//
+//go:embed *.sql
+var FS embed.FS